@@ -14,10 +14,80 @@
 
 package sysutil
 
+import (
+	"context"
+	"io"
+	"os"
+)
+
 // Export some function to for test purpose
 var (
 	ParseLogItem   = parseLogItem
 	ReadLastLines  = readLastLines
 	ParseTimeStamp = parseTimeStamp
-	ResolveFiles   = resolveFiles
 )
+
+// ResolveFiles resolves the log files without throttling.
+func ResolveFiles(ctx context.Context, logFilePath string, parser LogParser, beginTime, endTime int64) ([]logFile, error) {
+	return resolveFiles(ctx, logFilePath, parser, beginTime, endTime, &cursorThrottle{})
+}
+
+// SeekToTime seeks the log file without throttling.
+func SeekToTime(ctx context.Context, file *os.File, parser LogParser, ts int64) (int64, error) {
+	return seekToTime(ctx, file, parser, ts, &cursorThrottle{})
+}
+
+// CountLogs returns the number of the items of the log file in the time range.
+func CountLogs(ctx context.Context, logFilePath string, beginTime, endTime int64) (int, error) {
+	logFiles, err := resolveFiles(ctx, logFilePath, UnifiedLogParser{}, beginTime, endTime, &cursorThrottle{})
+	if err != nil {
+		return 0, err
+	}
+	iter := logIterator{
+		begin:   beginTime,
+		end:     endTime,
+		pending: logFiles,
+	}
+	defer iter.close()
+	var count int
+	for {
+		_, err := iter.next(ctx)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
+
+// SetReverseWindowSize sets the decompressed bytes of compressed file read at
+// a time backwards, and returns a function to restore it.
+func SetReverseWindowSize(size int64) func() {
+	old := reverseWindowSize
+	reverseWindowSize = size
+	return func() {
+		reverseWindowSize = old
+	}
+}
+
+// ReadCompressedBackwards reads the compressed log file backwards, and returns
+// the lines read and the bytes decompressed.
+func ReadCompressedBackwards(ctx context.Context, f logFile, begin, end int64) (int, int64, error) {
+	r, err := newReverseLineReader(ctx, f, f.parser, begin, end, &cursorThrottle{})
+	if err != nil {
+		return 0, 0, err
+	}
+	var lines int
+	for {
+		_, err := r.prevLine(ctx)
+		if err == io.EOF {
+			return lines, r.decompressed, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		lines++
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// contextRing keeps the last unmatched items of a file, which are returned
+// as the context items before the next match.
+type contextRing struct {
+	items []*LogEntry
+	start int
+	size  int
+}
+
+func newContextRing(n int) *contextRing {
+	return &contextRing{items: make([]*LogEntry, n)}
+}
+
+// push appends the item and drops the oldest one if the ring is full.
+func (r *contextRing) push(item *LogEntry) {
+	if r.size < len(r.items) {
+		r.items[(r.start+r.size)%len(r.items)] = item
+		r.size++
+		return
+	}
+	r.items[r.start] = item
+	r.start = (r.start + 1) % len(r.items)
+}
+
+// drain removes and returns the items in order.
+func (r *contextRing) drain() []*LogEntry {
+	items := make([]*LogEntry, 0, r.size)
+	for i := 0; i < r.size; i++ {
+		j := (r.start + i) % len(r.items)
+		items = append(items, r.items[j])
+		r.items[j] = nil
+	}
+	r.start, r.size = 0, 0
+	return items
+}
+
+// contextItems returns the numbers of the context items before and after the
+// matched items in the read order, which is reversed in reverse mode.
+func (iter *logIterator) contextItems() (preceding, trailing int) {
+	if iter.reverse {
+		return iter.contextAfter, iter.contextBefore
+	}
+	return iter.contextBefore, iter.contextAfter
+}
+
+// read reads the next matched item of the file. If WithContext is set, the
+// unmatched items around the matched items are returned as well and marked
+// as context. The context windows of nearby matches are merged, so an item is
+// never returned twice.
+func (c *logCursor) read(ctx context.Context) (*LogEntry, error) {
+	if len(c.queued) > 0 {
+		return c.dequeue(), nil
+	}
+	c.throttle.start()
+	defer c.throttle.stop()
+	for {
+		item, err := c.readInRange(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if c.iter.match(item) {
+			_, c.trailing = c.iter.contextItems()
+			entry := c.newEntry(item, false)
+			if c.iter.highlighted {
+				entry.Highlights = c.iter.highlight(item.Message)
+			}
+			if c.preceding == nil || c.preceding.size == 0 {
+				return entry, nil
+			}
+			c.queued = append(c.preceding.drain(), entry)
+			return c.dequeue(), nil
+		}
+		if c.trailing > 0 {
+			c.trailing--
+			return c.newEntry(item, true), nil
+		}
+		if c.preceding != nil {
+			c.preceding.push(c.newEntry(item, true))
+		}
+	}
+}
+
+// newEntry returns the entry of the item read last.
+func (c *logCursor) newEntry(item *pb.LogMessage, isContext bool) *LogEntry {
+	end := c.itemEnd
+	if c.offset() < 0 {
+		end = -1
+	}
+	return &LogEntry{
+		LogMessage: item,
+		Source:     c.source,
+		Context:    isContext,
+		rank:       c.rank,
+		end:        end,
+		trailing:   c.trailing,
+	}
+}
+
+func (c *logCursor) dequeue() *LogEntry {
+	entry := c.queued[0]
+	c.queued = c.queued[1:]
+	return entry
+}
@@ -0,0 +1,164 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// searchCursor is the position of a search after the returned items, which
+// is encoded as an opaque string by LogSearch.Cursor.
+type searchCursor struct {
+	// Time is the time of the last returned item
+	Time  int64        `json:"time"`
+	Files []cursorFile `json:"files"`
+}
+
+// cursorFile is the position of a file the items are returned from.
+type cursorFile struct {
+	// Dev, Ino, Begin and Size identify the file across rotations, the size
+	// of the file mustn't be less after the cursor is made.
+	Dev   uint64 `json:"dev"`
+	Ino   uint64 `json:"ino"`
+	Begin int64  `json:"begin"`
+	Size  int64  `json:"size"`
+	filePosition
+}
+
+// filePosition is the position to resume reading a file.
+type filePosition struct {
+	// Offset is the offset after the last returned item, which is the offset
+	// of the decompressed content for a compressed file.
+	Offset int64 `json:"offset"`
+	// Trailing is the number of the context items to return after the last
+	// returned item, see WithContext.
+	Trailing int `json:"trailing"`
+	// Time and Level of the last returned item are inherited by the invalid
+	// lines after it.
+	Time  int64       `json:"time"`
+	Level pb.LogLevel `json:"level"`
+}
+
+// WithCursor resumes the search from the cursor returned by LogSearch.Cursor
+// of a previous search with the same request, so that the items returned by
+// the previous search are skipped. The files are identified across rotations,
+// and the files changed in other ways are searched from the time of the last
+// returned item.
+func WithCursor(cursor string) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.cursor = cursor
+	}
+}
+
+// Cursor returns the opaque cursor of the search after the returned items,
+// which resumes the search by WithCursor, e.g. after the search is stopped at
+// a deadline or the limit. The searches with WithReverse, WithFollow or
+// WithDedup cannot be resumed.
+func (s *LogSearch) Cursor() (string, error) {
+	if s.iter.reverse || len(s.iter.follow) > 0 || s.dedup != nil {
+		return "", errors.New("the search cannot be resumed")
+	}
+	cursor := searchCursor{Time: s.lastTime}
+	ranks := make([]int, 0, len(s.positions))
+	for rank := range s.positions {
+		ranks = append(ranks, rank)
+	}
+	sort.Ints(ranks)
+	for _, rank := range ranks {
+		cursor.Files = append(cursor.Files, s.positions[rank])
+	}
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// track records the position after the returned entry.
+func (s *LogSearch) track(entry *LogEntry) {
+	s.lastTime = entry.Time
+	if entry.end < 0 {
+		return
+	}
+	if s.positions == nil {
+		s.positions = make(map[int]cursorFile)
+	}
+	pos, ok := s.positions[entry.rank]
+	if !ok {
+		f := s.iter.pending[entry.rank]
+		stat, err := f.file.Stat()
+		if err != nil {
+			return
+		}
+		pos.Dev, pos.Ino = fileIdentity(stat)
+		pos.Begin, pos.Size = f.begin, stat.Size()
+	}
+	pos.filePosition = filePosition{
+		Offset:   entry.end,
+		Trailing: entry.trailing,
+		Time:     entry.Time,
+		Level:    entry.Level,
+	}
+	s.positions[entry.rank] = pos
+}
+
+func decodeCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search log cursor: %v", err)
+	}
+	var cursor searchCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid search log cursor: %v", err)
+	}
+	return &cursor, nil
+}
+
+// position returns the position to resume reading the file, nil if the file
+// isn't in the cursor.
+func (c *searchCursor) position(f *logFile) *filePosition {
+	stat, err := f.file.Stat()
+	if err != nil {
+		return nil
+	}
+	dev, ino := fileIdentity(stat)
+	for i := range c.Files {
+		cf := &c.Files[i]
+		if cf.Dev == dev && cf.Ino == ino && cf.Begin == f.begin && cf.Size <= stat.Size() {
+			return &cf.filePosition
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from the underlying reader, so that
+// the offset of the items can be known.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,27 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package sysutil
+
+import "os"
+
+// fileIdentity returns zeros since the file index isn't exposed by
+// os.FileInfo on Windows, the files are identified by their first item time
+// and size only.
+func fileIdentity(stat os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
@@ -0,0 +1,106 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"strconv"
+)
+
+// logDeduper collapses the repeated items read by the iterator, see
+// WithDedup. The entries are returned in the order of their first items once
+// no more items can be collapsed into them.
+type logDeduper struct {
+	window int64 // in milliseconds, 0 if only consecutive items collapse
+
+	groups   []dedupGroup         // the open entries in order
+	open     map[string]*LogEntry // the open entries by key
+	lastTime int64                // the time of the last item read
+	err      error                // returned after the open entries
+}
+
+type dedupGroup struct {
+	key   string
+	entry *LogEntry
+}
+
+func newLogDeduper(window int64) *logDeduper {
+	return &logDeduper{
+		window: window,
+		open:   make(map[string]*LogEntry),
+	}
+}
+
+// dedupKey returns the key of the items which are collapsed together, the
+// variable parts of the message are masked like MineLogTemplates.
+func dedupKey(entry *LogEntry) string {
+	return entry.Source + "\x00" + strconv.FormatBool(entry.Context) + "\x00" +
+		entry.Level.String() + "\x00" + maskLogVariables(entry.Message)
+}
+
+func (d *logDeduper) next(ctx context.Context, iter *logIterator) (*LogEntry, error) {
+	for {
+		if len(d.groups) > 0 && (d.err != nil || d.closed(d.groups[0].entry)) {
+			g := d.groups[0]
+			d.groups = d.groups[1:]
+			if d.open[g.key] == g.entry {
+				delete(d.open, g.key)
+			}
+			return g.entry, nil
+		}
+		// All the open entries have been returned, e.g. there is no new log
+		// in follow mode
+		if err := d.err; err != nil {
+			d.err = nil
+			return nil, err
+		}
+		entry, err := iter.next(ctx)
+		if err != nil {
+			d.err = err
+			continue
+		}
+		d.add(entry)
+	}
+}
+
+// closed checks whether no more items can be collapsed into the entry.
+func (d *logDeduper) closed(entry *LogEntry) bool {
+	if d.window == 0 {
+		return entry != d.groups[len(d.groups)-1].entry
+	}
+	diff := d.lastTime - entry.Time
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > d.window
+}
+
+func (d *logDeduper) add(entry *LogEntry) {
+	d.lastTime = entry.Time
+	key := dedupKey(entry)
+	if open, ok := d.open[key]; ok && !d.closed(open) {
+		open.Repeats++
+		open.LastTime = entry.Time
+		return
+	}
+	// Only the last entry is open if only consecutive items collapse
+	if d.window == 0 && len(d.groups) > 0 {
+		delete(d.open, d.groups[len(d.groups)-1].key)
+	}
+	entry.Repeats = 1
+	entry.LastTime = entry.Time
+	d.groups = append(d.groups, dedupGroup{key: key, entry: entry})
+	d.open[key] = entry
+}
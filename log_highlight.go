@@ -0,0 +1,129 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LogRange is the byte range [Start, End) of a log message.
+type LogRange struct {
+	Start int
+	End   int
+}
+
+func (r LogRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// highlight returns the byte ranges of the message matched by the patterns
+// and the query terms, the excluding patterns and terms are ignored. The
+// overlapping ranges are merged.
+func (iter *logIterator) highlight(message string) []LogRange {
+	var ranges []LogRange
+	for _, group := range iter.patterns {
+		for i := range group {
+			if !group[i].negate {
+				ranges = append(ranges, group[i].ranges(message)...)
+			}
+		}
+	}
+	if iter.query != nil {
+		ranges = append(ranges, queryRanges(iter.query.root, message)...)
+	}
+	return mergeRanges(ranges)
+}
+
+// ranges returns the byte ranges of the non-overlapping matches of the
+// pattern, the empty matches are skipped.
+func (p *logPattern) ranges(message string) []LogRange {
+	var ranges []LogRange
+	switch {
+	case p.re != nil:
+		for _, loc := range p.re.FindAllStringIndex(message, -1) {
+			if loc[0] < loc[1] {
+				ranges = append(ranges, LogRange{Start: loc[0], End: loc[1]})
+			}
+		}
+	case p.literal == "":
+	case p.fold:
+		for i := 0; i+len(p.literal) <= len(message); {
+			if strings.EqualFold(message[i:i+len(p.literal)], p.literal) {
+				ranges = append(ranges, LogRange{Start: i, End: i + len(p.literal)})
+				i += len(p.literal)
+			} else {
+				i++
+			}
+		}
+	default:
+		for offset := 0; ; {
+			i := strings.Index(message[offset:], p.literal)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			offset = start + len(p.literal)
+			ranges = append(ranges, LogRange{Start: start, End: offset})
+		}
+	}
+	return ranges
+}
+
+// queryRanges returns the byte ranges of the message matched by the text and
+// regular expression terms of the query, except the negated ones.
+func queryRanges(node queryNode, message string) []LogRange {
+	var ranges []LogRange
+	switch n := node.(type) {
+	case *andNode:
+		for _, child := range n.children {
+			ranges = append(ranges, queryRanges(child, message)...)
+		}
+	case *orNode:
+		for _, child := range n.children {
+			ranges = append(ranges, queryRanges(child, message)...)
+		}
+	case *textNode:
+		p := logPattern{literal: n.text}
+		ranges = p.ranges(message)
+	case *regexpNode:
+		p := logPattern{re: n.compiled}
+		ranges = p.ranges(message)
+	}
+	return ranges
+}
+
+// mergeRanges sorts the ranges and merges the overlapping ones.
+func mergeRanges(ranges []LogRange) []LogRange {
+	if len(ranges) <= 1 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// LogHistogramBucket is the numbers of the log items of each level in the
+// time range [StartTime, StartTime+interval).
+type LogHistogramBucket struct {
+	// StartTime is the start of the bucket in unix milliseconds
+	StartTime int64
+	Counts    map[pb.LogLevel]int64
+}
+
+// LogHistogram counts the log items matched by the search request in the time
+// buckets of the interval, which are aligned to the unix epoch, e.g. per
+// minute. Only the non-empty buckets are returned in time order. See
+// NewLogSearch for the options accepted.
+func (d *DiagnosticsServer) LogHistogram(ctx context.Context, req *pb.SearchLogRequest, interval time.Duration, opts ...SearchLogOption) ([]*LogHistogramBucket, error) {
+	width := int64(interval / time.Millisecond)
+	if width <= 0 {
+		return nil, errors.New("the interval of log histogram must be at least 1ms")
+	}
+	search, err := d.newAggregatedSearch(ctx, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer search.Close()
+
+	buckets := make(map[int64]*LogHistogramBucket)
+	for {
+		entry, err := search.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Context {
+			continue
+		}
+		// round down for the items before the epoch as well
+		start := entry.Time - entry.Time%width
+		if entry.Time%width < 0 {
+			start -= width
+		}
+		bucket, ok := buckets[start]
+		if !ok {
+			bucket = &LogHistogramBucket{StartTime: start, Counts: make(map[pb.LogLevel]int64)}
+			buckets[start] = bucket
+		}
+		bucket.Counts[entry.Level]++
+	}
+
+	results := make([]*LogHistogramBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		results = append(results, bucket)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StartTime < results[j].StartTime
+	})
+	return results, nil
+}
+
+// sendLogHistogram sends the LogHistogram as the items of the stream, see
+// WithHistogram.
+func (d *DiagnosticsServer) sendLogHistogram(req *pb.SearchLogRequest, stream pb.Diagnostics_SearchLogServer, interval time.Duration, opts []SearchLogOption) error {
+	buckets, err := d.LogHistogram(stream.Context(), req, interval, opts...)
+	if err != nil {
+		return err
+	}
+	var messages []*pb.LogMessage
+	for _, bucket := range buckets {
+		levels := make([]pb.LogLevel, 0, len(bucket.Counts))
+		for level := range bucket.Counts {
+			levels = append(levels, level)
+		}
+		sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+		for _, level := range levels {
+			messages = append(messages, &pb.LogMessage{
+				Time:    bucket.StartTime,
+				Level:   level,
+				Message: strconv.FormatInt(bucket.Counts[level], 10),
+			})
+		}
+	}
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > 1024 {
+			n = 1024
+		}
+		if err := stream.Send(&pb.SearchLogResponse{Messages: messages[:n]}); err != nil {
+			return err
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
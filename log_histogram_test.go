@@ -0,0 +1,84 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogHistogram(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 300; i += 15 {
+		level := "INFO"
+		if i >= 120 && i < 180 {
+			level = "ERROR"
+		}
+		ts := atSecond(i).Format(sysutil.TimeStampLayout)
+		lines = append(lines, fmt.Sprintf(`[%s] [%s] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, ts, level, i))
+	}
+	s.writeTmpFile(t, "rpc.tidb.log", lines)
+
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"), sysutil.WithSearchLogLimit(1))
+	buckets, err := d.LogHistogram(context.Background(), &pb.SearchLogRequest{}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []*sysutil.LogHistogramBucket{
+		{StartTime: toMillis(atMinute(0)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Info: 4}},
+		{StartTime: toMillis(atMinute(1)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Info: 4}},
+		{StartTime: toMillis(atMinute(2)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Error: 4}},
+		{StartTime: toMillis(atMinute(3)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Info: 4}},
+		{StartTime: toMillis(atMinute(4)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Info: 4}},
+	}, buckets)
+
+	// filtered by the time range, the levels and the patterns
+	buckets, err = d.LogHistogram(context.Background(), &pb.SearchLogRequest{
+		StartTime: toMillis(atMinute(1)) + 30*1000,
+		EndTime:   toMillis(atMinute(3)),
+		Levels:    []pb.LogLevel{pb.LogLevel_Error, pb.LogLevel_Info},
+		Patterns:  []string{`line=\d*0\]`},
+	}, 2*time.Minute, sysutil.WithContext(1, 1))
+	require.NoError(t, err)
+	require.Equal(t, []*sysutil.LogHistogramBucket{
+		{StartTime: toMillis(atMinute(0)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Info: 1}},
+		{StartTime: toMillis(atMinute(2)), Counts: map[pb.LogLevel]int64{pb.LogLevel_Error: 2, pb.LogLevel_Info: 1}},
+	}, buckets)
+
+	_, err = d.LogHistogram(context.Background(), &pb.SearchLogRequest{}, 0)
+	require.Error(t, err)
+	_, err = d.LogHistogram(context.Background(), &pb.SearchLogRequest{}, time.Minute, sysutil.WithFollow(0))
+	require.Error(t, err)
+	_, err = d.LogHistogram(context.Background(), &pb.SearchLogRequest{}, time.Minute, sysutil.WithDedup(0))
+	require.Error(t, err)
+
+	// sent by SearchLog
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithHistogram(2 * time.Minute)}
+	messages := s.searchLog(t, &pb.SearchLogRequest{Patterns: []string{`line=\d*0\]`}})
+	require.Equal(t, []*pb.LogMessage{
+		{Time: toMillis(atMinute(0)), Level: pb.LogLevel_Info, Message: "4"},
+		{Time: toMillis(atMinute(2)), Level: pb.LogLevel_Info, Message: "2"},
+		{Time: toMillis(atMinute(2)), Level: pb.LogLevel_Error, Message: "2"},
+		{Time: toMillis(atMinute(4)), Level: pb.LogLevel_Info, Message: "2"},
+	}, messages)
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// logIndexSuffix is the suffix of the sidecar index of compressed log files
+	logIndexSuffix = ".idx"
+	// logIndexInterval is the decompressed bytes between two checkpoints
+	logIndexInterval = 1024 * 1024
+	// maxCachedLogIndexes is the maximum number of the indexes kept in memory
+	// because they cannot be persisted, e.g. the log directory is read-only
+	maxCachedLogIndexes = 1024
+)
+
+// logIndexCache keeps the indexes which cannot be persisted by the path of
+// their log files.
+var logIndexCache = struct {
+	sync.Mutex
+	indexes map[string]*logIndex
+}{indexes: make(map[string]*logIndex)}
+
+// logIndex is the sidecar time index of a compressed log file, which is
+// persisted to `<log file>.idx` and invalidated once the size or the
+// modification time of the log file changes.
+type logIndex struct {
+	Size        int64           `json:"size"`
+	ModTime     int64           `json:"mod_time"`
+	First       int64           `json:"first"`
+	Last        int64           `json:"last"`
+	Checkpoints []logCheckpoint `json:"checkpoints"`
+}
+
+// logCheckpoint is the beginning of a log item in a compressed log file.
+type logCheckpoint struct {
+	Time   int64 `json:"time"`
+	Offset int64 `json:"offset"` // The offset in the decompressed content
+}
+
+// loadLogIndex loads the index of the compressed log file from memory or the
+// sidecar file, it returns an error if the index doesn't exist or is out of
+// date.
+func loadLogIndex(path string, file *os.File) (*logIndex, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	logIndexCache.Lock()
+	index, ok := logIndexCache.indexes[path]
+	logIndexCache.Unlock()
+	if ok && index.matches(stat) {
+		return index, nil
+	}
+	data, err := ioutil.ReadFile(path + logIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	index = &logIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	if !index.matches(stat) {
+		return nil, errors.New("out of date log index")
+	}
+	return index, nil
+}
+
+func (index *logIndex) matches(stat os.FileInfo) bool {
+	return index.Size == stat.Size() && index.ModTime == stat.ModTime().UnixNano()
+}
+
+// storeLogIndex persists the index of the compressed log file, or keeps it in
+// memory if the log directory isn't writable.
+func storeLogIndex(path string, index *logIndex) {
+	err := saveLogIndex(path+logIndexSuffix, index)
+	logIndexCache.Lock()
+	defer logIndexCache.Unlock()
+	if err == nil {
+		delete(logIndexCache.indexes, path)
+		return
+	}
+	if _, ok := logIndexCache.indexes[path]; !ok && len(logIndexCache.indexes) >= maxCachedLogIndexes {
+		for p := range logIndexCache.indexes {
+			delete(logIndexCache.indexes, p)
+			break
+		}
+	}
+	logIndexCache.indexes[path] = index
+}
+
+// buildLogIndex builds the index of the compressed log file by decompressing
+// the whole file, and stores it.
+func buildLogIndex(ctx context.Context, file *os.File, parser LogParser, throttle *cursorThrottle) (*logIndex, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(throttle.reader(ctx, file))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(gr)
+	var b logIndexBuilder
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if item, err := parser.ParseLogItem(strings.TrimSpace(line)); err == nil {
+				b.add(item.Time, offset)
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isCtxDone(ctx) {
+			return nil, ctx.Err()
+		}
+		if err := throttle.pause(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return b.store(file.Name(), file)
+}
+
+// logIndexBuilder builds the index of a compressed log file from the items
+// read in order from the start of the file.
+type logIndexBuilder struct {
+	index          logIndex
+	found          bool
+	nextCheckpoint int64
+}
+
+// add adds the item at the decompressed offset to the index.
+func (b *logIndexBuilder) add(ts int64, offset int64) {
+	if !b.found {
+		b.index.First = ts
+		b.found = true
+	}
+	b.index.Last = ts
+	if offset >= b.nextCheckpoint {
+		b.index.Checkpoints = append(b.index.Checkpoints, logCheckpoint{Time: ts, Offset: offset})
+		b.nextCheckpoint = offset + logIndexInterval
+	}
+}
+
+// store stores the index after the whole file is read.
+func (b *logIndexBuilder) store(path string, file *os.File) (*logIndex, error) {
+	if !b.found {
+		return nil, errors.New("not a valid log file")
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index := b.index
+	index.Size = stat.Size()
+	index.ModTime = stat.ModTime().UnixNano()
+	storeLogIndex(path, &index)
+	return &index, nil
+}
+
+// seekCheckpoint returns the offset of the last checkpoint earlier than ts,
+// all the items before the offset are earlier than ts.
+func seekCheckpoint(checkpoints []logCheckpoint, ts int64) int64 {
+	var offset int64
+	for _, c := range checkpoints {
+		if c.Time >= ts {
+			break
+		}
+		offset = c.Offset
+	}
+	return offset
+}
+
+// saveLogIndex writes the index to a temporary file and renames it, so that
+// concurrent searches never read a partial index.
+func saveLogIndex(indexPath string, index *logIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(indexPath), filepath.Base(indexPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), indexPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// removeStaleLogIndex removes the index if its log file has been purged.
+func removeStaleLogIndex(indexPath string) {
+	if _, err := os.Stat(strings.TrimSuffix(indexPath, logIndexSuffix)); os.IsNotExist(err) {
+		_ = os.Remove(indexPath)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedLogIndex(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	// about 3MB after decompression
+	const lines = 40000
+	start, content := secondlyLogLines(lines)
+	s.writeTmpGzipFile(t, "rpc.tidb-1.log.gz", content)
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/27 06:00:00.000 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+	})
+	first, last := toMillis(start), toMillis(start.Add((lines-1)*time.Second))
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	indexPath := filepath.Join(s.tmpDir, "rpc.tidb-1.log.gz.idx")
+	indexExists := func() bool {
+		_, err := os.Stat(indexPath)
+		return err == nil
+	}
+
+	// the end time is unknown before the file is read out
+	logFiles, err := sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+	require.Equal(t, first, logFiles[0].BeginTime())
+	require.Equal(t, int64(math.MaxInt64), logFiles[0].EndTime())
+	require.Len(t, s.searchLog(t, &pb.SearchLogRequest{StartTime: first, EndTime: first + 10000}), 12)
+	require.False(t, indexExists())
+
+	// the index is built by the search reading the file out
+	require.Len(t, s.searchLog(t, &pb.SearchLogRequest{Patterns: []string{`line=39999\]`}}), 1)
+	require.True(t, indexExists())
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+	require.Equal(t, first, logFiles[0].BeginTime())
+	require.Equal(t, last, logFiles[0].EndTime())
+	index, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+
+	// the compressed file is pruned by the end time in the index
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, last+1, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 1)
+
+	// skip ahead by the checkpoints
+	for _, i := range []int{0, 1, 12345, 20000, 39999} {
+		begin := toMillis(start.Add(time.Duration(i) * time.Second))
+		end := toMillis(start.Add(time.Duration(i+10) * time.Second))
+		messages := s.searchLog(t, &pb.SearchLogRequest{StartTime: begin, EndTime: end})
+		require.NotEmpty(t, messages)
+		require.Equal(t, begin, messages[0].Time, "line %d", i)
+		require.Contains(t, messages[0].Message, "[line=", "line %d", i)
+	}
+
+	// read backwards window by window, a window per checkpoint if the
+	// window size is 1
+	for _, window := range []int64{0, 1} {
+		restore := func() {}
+		if window > 0 {
+			restore = sysutil.SetReverseWindowSize(window)
+		}
+		for _, lines := range [][2]int{{0, 10}, {10000, 30000}, {39990, 40000}} {
+			req := &pb.SearchLogRequest{
+				StartTime: toMillis(start.Add(time.Duration(lines[0]) * time.Second)),
+				EndTime:   toMillis(start.Add(time.Duration(lines[1]) * time.Second)),
+			}
+			for _, opts := range [][]sysutil.SearchLogOption{nil, {sysutil.WithMultilineAggregation(0)}} {
+				s.searchOpts = append(opts, sysutil.WithLimit(-1))
+				expect := s.searchLog(t, req)
+				for i, j := 0, len(expect)-1; i < j; i, j = i+1, j-1 {
+					expect[i], expect[j] = expect[j], expect[i]
+				}
+				s.searchOpts = append(s.searchOpts, sysutil.WithReverse())
+				require.Equal(t, expect, s.searchLog(t, req), "window %d, lines %v", window, lines)
+			}
+		}
+		restore()
+	}
+	s.searchOpts = nil
+
+	// the file is decompressed once within a window, and once for each
+	// window otherwise
+	size := int64(len(strings.Join(content, "\n")))
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	read, decompressed, err := sysutil.ReadCompressedBackwards(context.Background(), logFiles[0], 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Equal(t, len(content), read)
+	require.Equal(t, size, decompressed)
+	restore := sysutil.SetReverseWindowSize(1)
+	read, decompressed, err = sysutil.ReadCompressedBackwards(context.Background(), logFiles[0], 0, math.MaxInt64)
+	restore()
+	require.NoError(t, err)
+	require.Equal(t, len(content), read)
+	require.Greater(t, decompressed, 2*size)
+	require.Less(t, decompressed, 3*size)
+
+	// the index is rebuilt once the file changes
+	s.writeTmpGzipFile(t, "rpc.tidb-1.log.gz", content[:100])
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+	require.Equal(t, int64(math.MaxInt64), logFiles[0].EndTime())
+	require.Len(t, s.searchLog(t, &pb.SearchLogRequest{Patterns: []string{`line=0\]`}}), 1)
+	newIndex, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.NotEqual(t, index, newIndex)
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Less(t, logFiles[0].EndTime(), last)
+
+	// the index is removed once the file is purged
+	require.NoError(t, os.Remove(filepath.Join(s.tmpDir, "rpc.tidb-1.log.gz")))
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, 0, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 1)
+	require.False(t, indexExists())
+}
+
+func TestUnindexedCompressedLogs(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	// the backup files without rotation time in the name
+	s.writeTmpGzipFile(t, "rpc.tidb-a.log.gz", minutelyLogLines(0, 10, "Welcome to TiDB."))
+	s.writeTmpGzipFile(t, "rpc.tidb-b.log.gz", minutelyLogLines(10, 20, "Welcome to TiDB."))
+	s.writeTmpGzipFile(t, "rpc.tidb-c.log.gz", minutelyLogLines(20, 30, "Welcome to TiDB."))
+	s.writeTmpFile(t, "rpc.tidb.log", minutelyLogLines(30, 40, "Welcome to TiDB."))
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+
+	// the end time of the files is unknown until they are indexed, so none
+	// of them is pruned by the begin time
+	logFiles, err := sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(atMinute(15)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 4)
+	require.Equal(t, int64(math.MaxInt64), logFiles[0].EndTime())
+
+	// the index is built before the file is read backwards
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithReverse()}
+	messages := s.searchLog(t, &pb.SearchLogRequest{StartTime: toMillis(atMinute(5)), EndTime: toMillis(atMinute(14))})
+	require.Len(t, messages, 10)
+	require.Equal(t, toMillis(atMinute(14)), messages[0].Time)
+	require.Equal(t, toMillis(atMinute(5)), messages[9].Time)
+	_, err = os.Stat(filepath.Join(s.tmpDir, "rpc.tidb-a.log.gz.idx"))
+	require.NoError(t, err)
+	s.searchOpts = nil
+
+	// the indexed file is pruned by its end time
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(atMinute(15)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 3)
+	require.Equal(t, toMillis(atMinute(10)), logFiles[0].BeginTime())
+
+	// the index is kept in memory if it cannot be persisted
+	require.NoError(t, os.MkdirAll(filepath.Join(s.tmpDir, "rpc.tidb-c.log.gz.idx", "readonly"), 0755))
+	require.Len(t, s.searchLog(t, &pb.SearchLogRequest{StartTime: toMillis(atMinute(25))}), 15)
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(atMinute(25)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+	require.Equal(t, toMillis(atMinute(29)), logFiles[0].EndTime())
+}
+
+func TestOverlappedCompressedLogs(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	// a restored backup overlapping the active file
+	s.writeTmpGzipFile(t, "rpc.tidb-restored.log.gz", minutelyLogLines(0, 100, "restored"))
+	s.writeTmpFile(t, "rpc.tidb.log", minutelyLogLines(10, 200, "active"))
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithLimit(-1)}
+	var restored int
+	messages := s.searchLog(t, &pb.SearchLogRequest{StartTime: toMillis(atMinute(60))})
+	for _, m := range messages {
+		if strings.Contains(m.Message, `"restored"`) {
+			restored++
+		}
+	}
+	require.Equal(t, 40, restored)
+	require.Len(t, messages, 180)
+}
@@ -0,0 +1,289 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// LogParser parses a single log line into a log message, which carries
+// the timestamp in unix milliseconds, the log level and the log content.
+// It should return an error if the line is not the beginning of a log
+// item, e.g. a line of a stack trace, so that the line can be treated as
+// the continuation of the previous one.
+type LogParser interface {
+	ParseLogItem(line string) (*pb.LogMessage, error)
+}
+
+// MultilineLogParser is implemented by the parsers of the log formats whose
+// items span multiple lines, e.g. the slow query log. The continuation lines
+// are merged into the preceding item instead of being treated as separate
+// items.
+type MultilineLogParser interface {
+	LogParser
+	// Multiline reports whether the continuation lines should be merged.
+	Multiline() bool
+}
+
+func isMultiline(parser LogParser) bool {
+	p, ok := parser.(MultilineLogParser)
+	return ok && p.Multiline()
+}
+
+// The LogParserFunc type is an adapter to allow the use of ordinary
+// functions as log parsers.
+type LogParserFunc func(line string) (*pb.LogMessage, error)
+
+// ParseLogItem calls f(line).
+func (f LogParserFunc) ParseLogItem(line string) (*pb.LogMessage, error) {
+	return f(line)
+}
+
+// UnifiedLogParser parses logs in the TiDB / TiKV / PD unified log format,
+// it's the default parser of DiagnosticsServer.
+type UnifiedLogParser struct{}
+
+// ParseLogItem implements the LogParser interface.
+func (UnifiedLogParser) ParseLogItem(line string) (*pb.LogMessage, error) {
+	return parseLogItem(line)
+}
+
+// JSONLogParser parses JSON-lines logs produced by the zap JSON encoder,
+// e.g. pingcap/log configured with `format = "json"`:
+//
+// {"level":"INFO","time":"2019/08/26 06:19:13.011 -04:00","caller":"printer.go:41","message":"Welcome to TiDB.","Release Version":"v3.0.2"}
+// {"level":"info","ts":1566814753.011,"caller":"printer.go:41","msg":"Welcome to TiDB."}
+//
+// The log content is rendered in the unified log format, i.e.
+// `[printer.go:41] ["Welcome to TiDB."] ["Release Version"=v3.0.2]`, so the
+// patterns work the same way for both formats.
+type JSONLogParser struct{}
+
+// ParseLogItem implements the LogParser interface.
+func (JSONLogParser) ParseLogItem(line string) (*pb.LogMessage, error) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, fmt.Errorf("invalid log string: %s", line)
+	}
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var (
+		timeFound       bool
+		caller, message string
+		fields          []string
+		item            = &pb.LogMessage{}
+	)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid log string: %s", line)
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		switch key {
+		case "time", "ts":
+			item.Time, err = parseJSONTime(raw)
+			if err != nil {
+				return nil, err
+			}
+			timeFound = true
+		case "level":
+			var level string
+			if err := json.Unmarshal(raw, &level); err != nil {
+				return nil, err
+			}
+			item.Level = ParseLogLevel(level)
+		case "caller":
+			if err := json.Unmarshal(raw, &caller); err != nil {
+				return nil, err
+			}
+		case "msg", "message":
+			if err := json.Unmarshal(raw, &message); err != nil {
+				return nil, err
+			}
+		default:
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				// Not a string, keep the JSON representation of numbers,
+				// booleans, objects and arrays.
+				value = string(raw)
+			}
+			fields = append(fields, "["+quoteLogString(key)+"="+quoteLogString(value)+"]")
+		}
+	}
+	if !timeFound {
+		return nil, fmt.Errorf("invalid log string: %s", line)
+	}
+
+	var sections []string
+	if caller != "" {
+		sections = append(sections, "["+quoteLogString(caller)+"]")
+	}
+	if message != "" {
+		sections = append(sections, "["+quoteLogString(message)+"]")
+	}
+	item.Message = strings.Join(append(sections, fields...), " ")
+	return item, nil
+}
+
+// parseJSONTime parses the time field of JSON logs and returns the
+// timestamp in unix milliseconds. The time can be either a formatted
+// string or an epoch number in seconds, milliseconds or nanoseconds.
+func parseJSONTime(raw json.RawMessage) (int64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if ts, err := parseTimeStamp(s); err == nil {
+			return ts, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	epoch, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case epoch > 1e15:
+		return int64(epoch / 1e6), nil
+	case epoch > 1e12:
+		return int64(epoch), nil
+	default:
+		return int64(epoch * 1e3), nil
+	}
+}
+
+// quoteLogString quotes s the same way as the pingcap/log text encoder.
+func quoteLogString(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b <= 0x20, b == '\\', b == '"', b == '[', b == ']', b == '=':
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// LogField is a key/value field of a unified format log.
+type LogField struct {
+	Key   string
+	Value string
+}
+
+// StructuredLog is the structured content of a unified format log, i.e.
+// `[printer.go:41] ["Welcome to TiDB."] ["Release Version"=v3.0.2]`.
+type StructuredLog struct {
+	// Source is the source location, e.g. printer.go:41
+	Source string
+	// Message is the unquoted log message, e.g. Welcome to TiDB.
+	Message string
+	// Fields are the unquoted key/value fields in their original order.
+	Fields []LogField
+}
+
+// Field returns the value of the first field named key.
+func (l *StructuredLog) Field(key string) (string, bool) {
+	for _, f := range l.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+var sourceLocationRegexp = regexp.MustCompile(`^\S+:\d+$`)
+
+// ParseStructuredLog parses the content of a unified format log, which is
+// the `Message` of the items returned by UnifiedLogParser and JSONLogParser.
+func ParseStructuredLog(s string) (*StructuredLog, error) {
+	l := &StructuredLog{}
+	var messageFound bool
+	for s = strings.TrimSpace(s); len(s) > 0; s = strings.TrimSpace(s) {
+		if s[0] != '[' {
+			return nil, fmt.Errorf("invalid log content: %s", s)
+		}
+		key, rest, err := readLogString(s[1:], "=]")
+		if err != nil {
+			return nil, err
+		}
+		if rest[0] == '=' {
+			var value string
+			value, rest, err = readLogString(rest[1:], "]")
+			if err != nil {
+				return nil, err
+			}
+			l.Fields = append(l.Fields, LogField{Key: key, Value: value})
+		} else if len(l.Fields) > 0 || messageFound {
+			return nil, fmt.Errorf("invalid log content: %s", s)
+		} else if l.Source == "" && sourceLocationRegexp.MatchString(key) {
+			l.Source = key
+		} else {
+			l.Message = key
+			messageFound = true
+		}
+		s = rest[1:]
+	}
+	return l, nil
+}
+
+// readLogString reads a string quoted by quoteLogString from the start of
+// s, which must be followed by a byte in delims. It returns the unquoted
+// string and the rest of s starting with the delimiter.
+func readLogString(s string, delims string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, delims)
+		if i < 0 {
+			return "", "", fmt.Errorf("invalid log content: %s", s)
+		}
+		return s[:i], s[i:], nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			unquoted, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", err
+			}
+			if i+1 == len(s) || strings.IndexByte(delims, s[i+1]) < 0 {
+				return "", "", fmt.Errorf("invalid log content: %s", s)
+			}
+			return unquoted, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid log content: %s", s)
+}
@@ -0,0 +1,266 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+// parses lines like `2019-08-26T06:19:13Z INFO message`
+func parseSpaceSeparatedLog(line string) (*pb.LogMessage, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid log string: %s", line)
+	}
+	t, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LogMessage{
+		Time:    t.UnixNano() / int64(time.Millisecond),
+		Level:   sysutil.ParseLogLevel(parts[1]),
+		Message: parts[2],
+	}, nil
+}
+
+func TestCustomLogParser(t *testing.T) {
+	s, clean := createSearchLogSuite(t, sysutil.WithLogParser(sysutil.LogParserFunc(parseSpaceSeparatedLog)))
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb-1.log", []string{
+		`2019-08-26T06:19:13Z INFO first file`,
+		`2019-08-26T06:19:14Z ERROR something wrong`,
+	})
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`2019-08-26T06:20:13Z WARN second file`,
+		`stack trace line`,
+		`2019-08-26T06:20:14Z INFO done`,
+	})
+
+	begin := time.Date(2019, 8, 26, 6, 19, 14, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	end := time.Date(2019, 8, 26, 6, 20, 13, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	messages := s.searchLog(t, &pb.SearchLogRequest{
+		StartTime: begin,
+		EndTime:   end,
+	})
+	require.Equal(t, []*pb.LogMessage{
+		{Time: begin, Level: pb.LogLevel_Error, Message: "something wrong"},
+		{Time: end, Level: pb.LogLevel_Warn, Message: "second file"},
+		{Time: end, Level: pb.LogLevel_Warn, Message: "stack trace line"},
+	}, messages)
+
+	// the default unified log parser cannot parse these files
+	logFiles, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "rpc.tidb.log"), sysutil.UnifiedLogParser{}, begin, end)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 0)
+}
+
+func TestJSONLogParser(t *testing.T) {
+	cases := []struct {
+		raw     string
+		time    string
+		level   pb.LogLevel
+		message string
+	}{
+		{
+			raw:     `{"level":"INFO","time":"2019/08/26 06:19:15.011 -04:00","caller":"printer.go:41","message":"Welcome to TiDB.","Release Version":"v3.0.2","conn":12,"ok":true}`,
+			time:    `2019/08/26 06:19:15.011 -04:00`,
+			level:   pb.LogLevel_Info,
+			message: `[printer.go:41] ["Welcome to TiDB."] ["Release Version"=v3.0.2] [conn=12] [ok=true]`,
+		},
+		{
+			raw:     `{"level":"error","ts":1566814755.011,"caller":"printer.go:41","msg":"boom","error":"a=b","obj":{"k":[1,2]}}`,
+			time:    `2019/08/26 06:19:15.011 -04:00`,
+			level:   pb.LogLevel_Error,
+			message: `[printer.go:41] [boom] [error="a=b"] [obj="{\"k\":[1,2]}"]`,
+		},
+		{
+			raw:     `{"level":"warn","ts":"2019-08-26T10:19:15.011Z","msg":"no caller"}`,
+			time:    `2019/08/26 06:19:15.011 -04:00`,
+			level:   pb.LogLevel_Warn,
+			message: `["no caller"]`,
+		},
+	}
+
+	for _, cas := range cases {
+		item, err := sysutil.JSONLogParser{}.ParseLogItem(cas.raw)
+		require.NoError(t, err)
+		tt, err := sysutil.ParseTimeStamp(cas.time)
+		require.NoError(t, err)
+		require.Equal(t, tt, item.Time)
+		require.Equal(t, cas.level, item.Level)
+		require.Equal(t, cas.message, item.Message)
+	}
+
+	for _, raw := range []string{
+		`[2019/08/26 06:19:15.011 -04:00] [ERROR] [printer.go:41] ["Welcome to TiDB."]`,
+		`{"level":"INFO","msg":"missing time"}`,
+		`{"level":"INFO","time":"2019/08/26 06:19:15.011 -04:00"`,
+		`goroutine 1 [running]:`,
+	} {
+		_, err := sysutil.JSONLogParser{}.ParseLogItem(raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestSearchJSONLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t, sysutil.WithLogParser(sysutil.JSONLogParser{}))
+	defer clean()
+
+	s.writeTmpGzipFile(t, "rpc.tidb-2019-08-26T06-19-15.000.log.gz", []string{
+		`{"level":"INFO","time":"2019/08/26 06:19:13.011 -04:00","caller":"printer.go:41","message":"Welcome to TiDB."}`,
+		`{"level":"ERROR","time":"2019/08/26 06:19:14.011 -04:00","caller":"txn.go:10","message":"txn conflict","conn":1}`,
+	})
+	s.writeTmpFile(t, "rpc.tidb-2019-08-26T06-20-15.000.log", []string{
+		`{"level":"WARN","time":"2019/08/26 06:20:13.011 -04:00","caller":"txn.go:10","message":"txn conflict","conn":2}`,
+		`{"level":"INFO","time":"2019/08/26 06:20:14.011 -04:00","caller":"printer.go:41","message":"Welcome to TiDB."}`,
+	})
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`{"level":"ERROR","time":"2019/08/26 06:21:13.011 -04:00","caller":"txn.go:10","message":"txn conflict","conn":3}`,
+		`goroutine 1 [running]:`,
+		`{"level":"INFO","time":"2019/08/26 06:21:14.011 -04:00","caller":"printer.go:41","message":"Welcome to TiDB."}`,
+	})
+
+	end, err := sysutil.ParseTimeStamp("2019/08/26 06:22:00.000 -04:00")
+	require.NoError(t, err)
+	messages := s.searchLog(t, &pb.SearchLogRequest{
+		StartTime: 0,
+		EndTime:   end,
+		Levels:    []pb.LogLevel{pb.LogLevel_Error},
+		Patterns:  []string{`conn=\d`},
+	})
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.Message)
+	}
+	require.Equal(t, []string{
+		`[txn.go:10] ["txn conflict"] [conn=1]`,
+		`[txn.go:10] ["txn conflict"] [conn=3]`,
+	}, got)
+
+	// time range pruning on the rotated files, the compressed file is indexed
+	// by the search
+	begin, err := sysutil.ParseTimeStamp("2019/08/26 06:20:14.000 -04:00")
+	require.NoError(t, err)
+	logFiles, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "rpc.tidb.log"), sysutil.JSONLogParser{}, begin, end)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+}
+
+func TestParseStructuredLog(t *testing.T) {
+	cases := []struct {
+		raw    string
+		expect *sysutil.StructuredLog
+	}{
+		{
+			raw: `[printer.go:41] ["Welcome to TiDB."] ["Release Version"=v3.0.2] [conn=123] [sql="select * from t where a = \"]\""]`,
+			expect: &sysutil.StructuredLog{
+				Source:  "printer.go:41",
+				Message: "Welcome to TiDB.",
+				Fields: []sysutil.LogField{
+					{Key: "Release Version", Value: "v3.0.2"},
+					{Key: "conn", Value: "123"},
+					{Key: "sql", Value: `select * from t where a = "]"`},
+				},
+			},
+		},
+		{
+			raw: `[util.go:60] [PD] [release-version=v3.0.2]`,
+			expect: &sysutil.StructuredLog{
+				Source:  "util.go:60",
+				Message: "PD",
+				Fields:  []sysutil.LogField{{Key: "release-version", Value: "v3.0.2"}},
+			},
+		},
+		{
+			raw:    `["no source"] [txnStartTS=415310049048412161] [empty=""]`,
+			expect: &sysutil.StructuredLog{Message: "no source", Fields: []sysutil.LogField{{Key: "txnStartTS", Value: "415310049048412161"}, {Key: "empty"}}},
+		},
+		{
+			raw:    `[mod.rs:28]`,
+			expect: &sysutil.StructuredLog{Source: "mod.rs:28"},
+		},
+	}
+	for _, cas := range cases {
+		l, err := sysutil.ParseStructuredLog(cas.raw)
+		require.NoError(t, err, cas.raw)
+		require.Equal(t, cas.expect, l)
+	}
+
+	l, err := sysutil.ParseStructuredLog(cases[0].raw)
+	require.NoError(t, err)
+	v, ok := l.Field("conn")
+	require.True(t, ok)
+	require.Equal(t, "123", v)
+	_, ok = l.Field("region_id")
+	require.False(t, ok)
+
+	for _, raw := range []string{
+		`This is an invalid log blablabla][`,
+		`[printer.go:41] ["unterminated]`,
+		`[printer.go:41] ["a"b]`,
+		`[printer.go:41] [a=1] [message after fields]`,
+		`[printer.go:41] [a=1`,
+	} {
+		_, err := sysutil.ParseStructuredLog(raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestSearchLogFieldFilter(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [session.go:41] ["execute sql"] [conn=123] [txnStartTS=1]`,
+		`[2019/08/26 06:19:14.011 -04:00] [INFO] [session.go:41] ["execute sql"] [conn=1234] [txnStartTS=1]`,
+		`[2019/08/26 06:19:15.011 -04:00] [WARN] [session.go:41] ["execute sql"] [conn=123] [txnStartTS=2]`,
+		`stack trace conn=123`,
+		`[2019/08/26 06:19:16.011 -04:00] [INFO] [region.go:41] ["region epoch not match"] [region_id=42]`,
+	})
+
+	messages := func() []string {
+		var res []string
+		for _, m := range s.searchLog(t, &pb.SearchLogRequest{}) {
+			res = append(res, m.Message)
+		}
+		return res
+	}
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFieldFilter("conn", "123")}
+	require.Equal(t, []string{
+		`[session.go:41] ["execute sql"] [conn=123] [txnStartTS=1]`,
+		`[session.go:41] ["execute sql"] [conn=123] [txnStartTS=2]`,
+	}, messages())
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFieldFilter("conn", "123"), sysutil.WithFieldFilter("txnStartTS", "2")}
+	require.Equal(t, []string{
+		`[session.go:41] ["execute sql"] [conn=123] [txnStartTS=2]`,
+	}, messages())
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFieldFilter("region_id", "42")}
+	require.Equal(t, []string{
+		`[region.go:41] ["region epoch not match"] [region_id=42]`,
+	}, messages())
+}
@@ -0,0 +1,143 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// prefetchBatchSize is the number of the matched items sent by a background
+// scan at a time, and at most prefetchBatches batches are buffered.
+const (
+	prefetchBatchSize = 256
+	prefetchBatches   = 4
+)
+
+// logBatch is a batch of the matched items of a background scan, err is set
+// by the last batch.
+type logBatch struct {
+	items []*LogEntry
+	err   error
+}
+
+// prefetchAhead starts to scan the next pending files in background until
+// the number of the running scans reaches the parallelism. The files are
+// decompressed and filtered concurrently, while the items are still merged
+// in time order by the iterator.
+func (iter *logIterator) prefetchAhead(ctx context.Context) {
+	if iter.parallelism <= 1 {
+		return
+	}
+	if iter.cancel == nil {
+		iter.scanCtx, iter.cancel = context.WithCancel(ctx)
+	}
+	for iter.started < len(iter.order) && atomic.LoadInt32(&iter.running) < int32(iter.parallelism) {
+		f := iter.pending[iter.order[iter.started]]
+		// The followed file is read by the iterator
+		if _, ok := iter.followedSource(f); ok {
+			return
+		}
+		iter.ahead = append(iter.ahead, iter.prefetch(iter.order[iter.started]))
+		iter.started++
+	}
+}
+
+// prefetch starts to scan the pending file at index i in background.
+func (iter *logIterator) prefetch(i int) *logCursor {
+	f := iter.pending[i]
+	c := iter.newCursor(i, f.source, f.parser)
+	c.batches = make(chan logBatch, prefetchBatches)
+	atomic.AddInt32(&iter.running, 1)
+	iter.wg.Add(1)
+	go func() {
+		defer iter.wg.Done()
+		defer close(c.batches)
+		// A panic in the background isn't recovered by the caller of the
+		// search
+		defer func() {
+			if r := recover(); r != nil {
+				select {
+				case c.batches <- logBatch{err: searchLogPanicError(r)}:
+				case <-iter.scanCtx.Done():
+				}
+			}
+		}()
+		running := true
+		done := func() {
+			if running {
+				atomic.AddInt32(&iter.running, -1)
+				running = false
+			}
+		}
+		defer done()
+
+		ctx := iter.scanCtx
+		err := c.open(ctx, f)
+		var items []*LogEntry
+		for {
+			if err == nil {
+				var item *LogEntry
+				if item, err = c.read(ctx); err == nil {
+					items = append(items, item)
+					if len(items) < prefetchBatchSize {
+						continue
+					}
+				}
+			}
+			// Let the next file be scanned while the batches are consumed
+			if err != nil {
+				done()
+			}
+			select {
+			case c.batches <- logBatch{items: items, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			items = nil
+		}
+	}()
+	return c
+}
+
+// nextPrefetched returns the next matched item of the background scan.
+func (c *logCursor) nextPrefetched(ctx context.Context) (*LogEntry, error) {
+	for len(c.buffered) == 0 {
+		if c.err != nil {
+			return nil, c.err
+		}
+		select {
+		case b, ok := <-c.batches:
+			// The scan has been canceled before sending the last batch
+			if !ok {
+				c.err = c.iter.scanCtx.Err()
+				if c.err == nil {
+					c.err = io.EOF
+				}
+				return nil, c.err
+			}
+			c.buffered, c.err = b.items, b.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	item := c.buffered[0]
+	c.buffered = c.buffered[1:]
+	return item, nil
+}
@@ -0,0 +1,538 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// LogQuery is a boolean query of log items, e.g.
+//
+//	level:error AND (region_id=42 OR "txn conflict") AND NOT gc
+//
+// The terms of the query are:
+//
+//   - level:<level> matches the items of the log level, e.g. level:warn
+//   - <key>=<value> matches the items having the structured field with the
+//     exact value, e.g. conn=123 or txn="a b", see ParseStructuredLog
+//   - a word or a "quoted phrase" matches the items containing it
+//   - /regexp/ matches the items by the regular expression, and /regexp/i
+//     matches case-insensitively
+//
+// The terms are combined by AND, OR, NOT and parentheses, AND binds tighter
+// than OR and the terms next to each other are AND-ed. The keywords must be
+// uppercase.
+type LogQuery struct {
+	root queryNode
+}
+
+// LogQuerySyntaxError is the error of parsing an invalid LogQuery.
+type LogQuerySyntaxError struct {
+	// Offset is the byte offset of the error in the query.
+	Offset int
+	Msg    string
+}
+
+func (e *LogQuerySyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// ParseLogQuery parses a LogQuery, a *LogQuerySyntaxError is returned if the
+// query is invalid.
+func ParseLogQuery(s string) (*LogQuery, error) {
+	tokens, err := lexLogQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &LogQuerySyntaxError{Offset: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok)}
+	}
+	return &LogQuery{root: root}, nil
+}
+
+// Match checks whether the item matches the query.
+func (q *LogQuery) Match(item *pb.LogMessage) bool {
+	return q.root.eval(&queryTarget{item: item})
+}
+
+// PushDown sets the Levels and Patterns of the search request to filter the
+// items by the query as much as possible, so that the query can be searched
+// by SearchLog. It returns true if the results of the request match the query
+// exactly, otherwise the results should be filtered by Match.
+func (q *LogQuery) PushDown(req *pb.SearchLogRequest) bool {
+	req.Levels, req.Patterns = nil, nil
+	exact := true
+	var levelsPushed bool
+	for _, node := range flattenAnd(q.root) {
+		if levels, ok := levelsOf(node); ok && !levelsPushed {
+			req.Levels = levels
+			levelsPushed = true
+			// The items of unknown log level are always kept by SearchLog
+			exact = false
+			continue
+		}
+		patterns, ok, nodeExact := patternsOf(node)
+		if !ok {
+			exact = false
+			continue
+		}
+		req.Patterns = append(req.Patterns, patterns...)
+		exact = exact && nodeExact
+	}
+	return exact
+}
+
+// flattenAnd returns the operands of the top level conjunction.
+func flattenAnd(node queryNode) []queryNode {
+	and, ok := node.(*andNode)
+	if !ok {
+		return []queryNode{node}
+	}
+	var nodes []queryNode
+	for _, child := range and.children {
+		nodes = append(nodes, flattenAnd(child)...)
+	}
+	return nodes
+}
+
+// levelsOf returns the levels if the node is a level term or a disjunction of
+// level terms.
+func levelsOf(node queryNode) ([]pb.LogLevel, bool) {
+	switch n := node.(type) {
+	case *levelNode:
+		return []pb.LogLevel{n.level}, true
+	case *orNode:
+		var levels []pb.LogLevel
+		for _, child := range n.children {
+			l, ok := levelsOf(child)
+			if !ok {
+				return nil, false
+			}
+			levels = append(levels, l...)
+		}
+		return levels, true
+	}
+	return nil, false
+}
+
+// patternsOf returns the patterns of SearchLogRequest matching the node, see
+// parseLogPatterns. The patterns may match more items than the node if it
+// has field terms.
+func patternsOf(node queryNode) (patterns []string, ok bool, exact bool) {
+	if or, isOr := node.(*orNode); isOr {
+		exact = true
+		for i, child := range or.children {
+			p, ok, childExact := patternOf(child)
+			if !ok {
+				return nil, false, false
+			}
+			if i > 0 {
+				p = "|" + p
+			}
+			patterns = append(patterns, p)
+			exact = exact && childExact
+		}
+		return patterns, true, exact
+	}
+	p, ok, exact := patternOf(node)
+	if !ok {
+		return nil, false, false
+	}
+	return []string{p}, true, exact
+}
+
+func patternOf(node queryNode) (string, bool, bool) {
+	switch n := node.(type) {
+	case *notNode:
+		p, ok, exact := patternOf(n.child)
+		// The superset of the child cannot be negated
+		if !ok || !exact {
+			return "", false, false
+		}
+		return "!" + p, true, true
+	case *textNode:
+		return textPattern(n.text), true, true
+	case *regexpNode:
+		if n.fold {
+			return "~(?:" + n.re + ")", true, true
+		}
+		return "(?:" + n.re + ")", true, true
+	case *fieldNode:
+		// The rendered field may appear in the message as well
+		return textPattern("[" + quoteLogString(n.key) + "=" + quoteLogString(n.value) + "]"), true, false
+	}
+	return "", false, false
+}
+
+// textPattern returns the pattern matching the text literally.
+func textPattern(text string) string {
+	p := regexp.QuoteMeta(text)
+	if strings.HasPrefix(p, "!") || strings.HasPrefix(p, "~") {
+		p = `\` + p
+	}
+	return p
+}
+
+type queryNode interface {
+	eval(t *queryTarget) bool
+}
+
+// queryTarget is the item evaluated by the query, the structured log is
+// parsed lazily.
+type queryTarget struct {
+	item       *pb.LogMessage
+	structured *StructuredLog
+	parsed     bool
+}
+
+func (t *queryTarget) field(key string) (string, bool) {
+	if !t.parsed {
+		t.parsed = true
+		t.structured, _ = ParseStructuredLog(firstLine(t.item.Message))
+	}
+	if t.structured == nil {
+		return "", false
+	}
+	return t.structured.Field(key)
+}
+
+type andNode struct{ children []queryNode }
+
+func (n *andNode) eval(t *queryTarget) bool {
+	for _, child := range n.children {
+		if !child.eval(t) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode struct{ children []queryNode }
+
+func (n *orNode) eval(t *queryTarget) bool {
+	for _, child := range n.children {
+		if child.eval(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct{ child queryNode }
+
+func (n *notNode) eval(t *queryTarget) bool {
+	return !n.child.eval(t)
+}
+
+type levelNode struct{ level pb.LogLevel }
+
+func (n *levelNode) eval(t *queryTarget) bool {
+	return t.item.Level == n.level
+}
+
+type fieldNode struct{ key, value string }
+
+func (n *fieldNode) eval(t *queryTarget) bool {
+	v, ok := t.field(n.key)
+	return ok && v == n.value
+}
+
+type textNode struct{ text string }
+
+func (n *textNode) eval(t *queryTarget) bool {
+	return strings.Contains(t.item.Message, n.text)
+}
+
+type regexpNode struct {
+	re       string
+	fold     bool
+	compiled *regexp.Regexp
+}
+
+func (n *regexpNode) eval(t *queryTarget) bool {
+	return n.compiled.MatchString(t.item.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenTerm
+)
+
+type queryToken struct {
+	kind tokenKind
+	pos  int
+	term queryNode
+	text string
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenTerm:
+		return fmt.Sprintf("term %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexLogQuery splits the query into tokens, the terms are parsed as well.
+func lexLogQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; ; {
+		for i < len(s) && isQuerySpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return append(tokens, queryToken{kind: tokenEOF, pos: i}), nil
+		}
+		start := i
+		switch s[i] {
+		case '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen, pos: i, text: "("})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen, pos: i, text: ")"})
+			i++
+			continue
+		case '"':
+			text, n, err := readQueryString(s, i)
+			if err != nil {
+				return nil, err
+			}
+			i += n
+			tokens = append(tokens, queryToken{kind: tokenTerm, pos: start, term: &textNode{text: text}, text: s[start:i]})
+			continue
+		case '/':
+			node, n, err := readQueryRegexp(s, i)
+			if err != nil {
+				return nil, err
+			}
+			i += n
+			tokens = append(tokens, queryToken{kind: tokenTerm, pos: start, term: node, text: s[start:i]})
+			continue
+		}
+
+		// a keyword, a bare word or a term with a key
+		for i < len(s) && !isQuerySpace(s[i]) && s[i] != '(' && s[i] != ')' && s[i] != '"' {
+			i++
+		}
+		word := s[start:i]
+		switch word {
+		case "AND":
+			tokens = append(tokens, queryToken{kind: tokenAnd, pos: start, text: word})
+			continue
+		case "OR":
+			tokens = append(tokens, queryToken{kind: tokenOr, pos: start, text: word})
+			continue
+		case "NOT":
+			tokens = append(tokens, queryToken{kind: tokenNot, pos: start, text: word})
+			continue
+		}
+		if strings.HasPrefix(word, "level:") {
+			level := ParseLogLevel(strings.ToLower(word[len("level:"):]))
+			if level == pb.LogLevel_UNKNOWN {
+				return nil, &LogQuerySyntaxError{Offset: start + len("level:"), Msg: fmt.Sprintf("unknown log level %q", word[len("level:"):])}
+			}
+			tokens = append(tokens, queryToken{kind: tokenTerm, pos: start, term: &levelNode{level: level}, text: word})
+			continue
+		}
+		eq := strings.IndexByte(word, '=')
+		if eq < 0 {
+			if i < len(s) && s[i] == '"' {
+				return nil, &LogQuerySyntaxError{Offset: i, Msg: "unexpected quote"}
+			}
+			tokens = append(tokens, queryToken{kind: tokenTerm, pos: start, term: &textNode{text: word}, text: word})
+			continue
+		}
+		if eq == 0 {
+			return nil, &LogQuerySyntaxError{Offset: start, Msg: "missing field name"}
+		}
+		value := word[eq+1:]
+		if value == "" && i < len(s) && s[i] == '"' {
+			text, n, err := readQueryString(s, i)
+			if err != nil {
+				return nil, err
+			}
+			value = text
+			i += n
+		} else if i < len(s) && s[i] == '"' {
+			return nil, &LogQuerySyntaxError{Offset: i, Msg: "unexpected quote"}
+		}
+		tokens = append(tokens, queryToken{kind: tokenTerm, pos: start, term: &fieldNode{key: word[:eq], value: value}, text: s[start:i]})
+	}
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// readQueryString reads the quoted string at s[start], in which `\"` and `\\`
+// are escaped. It returns the unquoted string and the length of the quoted
+// string.
+func readQueryString(s string, start int) (string, int, error) {
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+			}
+		case '"':
+			return b.String(), i + 1 - start, nil
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, &LogQuerySyntaxError{Offset: start, Msg: "unterminated quoted string"}
+}
+
+// readQueryRegexp reads the regular expression term at s[start], in which
+// `\/` is escaped.
+func readQueryRegexp(s string, start int) (*regexpNode, int, error) {
+	var b strings.Builder
+	for i := start + 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != '/' {
+				b.WriteByte(c)
+			}
+			b.WriteByte(s[i])
+		case c == '/':
+			node := &regexpNode{re: b.String()}
+			expr := node.re
+			end := i + 1
+			if end < len(s) && s[end] == 'i' && (end+1 == len(s) || isQuerySpace(s[end+1]) || s[end+1] == ')') {
+				node.fold = true
+				expr = "(?i)" + expr
+				end++
+			}
+			compiled, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, 0, &LogQuerySyntaxError{Offset: start, Msg: err.Error()}
+			}
+			node.compiled = compiled
+			return node, end - start, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, 0, &LogQuerySyntaxError{Offset: start, Msg: "unterminated regular expression"}
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) advance() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseOr parses `and { OR and }`.
+func (p *queryParser) parseOr() (queryNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{node}
+	for p.peek().kind == tokenOr {
+		p.advance()
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &orNode{children: children}, nil
+}
+
+// parseAnd parses `not { [AND] not }`.
+func (p *queryParser) parseAnd() (queryNode, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{node}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.advance()
+		case tokenNot, tokenLParen, tokenTerm:
+		default:
+			if len(children) == 1 {
+				return children[0], nil
+			}
+			return &andNode{children: children}, nil
+		}
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+}
+
+// parseNot parses `NOT not | ( or ) | term`.
+func (p *queryParser) parseNot() (queryNode, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case tokenNot:
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child: child}, nil
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.advance(); next.kind != tokenRParen {
+			return nil, &LogQuerySyntaxError{Offset: next.pos, Msg: fmt.Sprintf("expected \")\" but got %s", next)}
+		}
+		return node, nil
+	case tokenTerm:
+		return tok.term, nil
+	}
+	return nil, &LogQuerySyntaxError{Offset: tok.pos, Msg: fmt.Sprintf("expected a term but got %s", tok)}
+}
@@ -0,0 +1,124 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"testing"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchLogQuery(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [INFO] [gc_worker.go:230] ["[gc worker] start"] [region_id=42]`,
+		`[2019/08/26 06:19:15.011 -04:00] [ERROR] [misc.go:91] ["panic"] [region_id=42]`,
+		`[2019/08/26 06:19:16.011 -04:00] [ERROR] [session.go:1014] ["txn conflict, retry"] [region_id=7]`,
+		`[2019/08/26 06:19:17.011 -04:00] [ERROR] [gc_worker.go:230] ["txn conflict in gc"] [txn="a b"]`,
+		`[2019/08/26 06:19:18.011 -04:00] [WARN] [session.go:1014] ["!important (1/2)"]`,
+	})
+
+	cases := []struct {
+		query  string
+		expect []int
+		exact  bool
+	}{
+		{query: `level:error AND (region_id=42 OR "txn conflict") AND NOT gc`, expect: []int{2, 3}},
+		{query: `gc`, expect: []int{1, 4}, exact: true},
+		{query: `NOT gc NOT /^\[printer/`, expect: []int{2, 3, 5}, exact: true},
+		{query: `"txn conflict" OR panic`, expect: []int{2, 3, 4}, exact: true},
+		{query: `level:ERROR OR level:warn`, expect: []int{2, 3, 4, 5}},
+		{query: `level:info OR gc`, expect: []int{0, 1, 4}},
+		{query: `region_id=42 level:info`, expect: []int{1}},
+		{query: `txn="a b"`, expect: []int{4}},
+		{query: `NOT region_id=42 AND NOT level:warn`, expect: []int{0, 3, 4}},
+		{query: `/WELCOME/i OR "!important (1/2)"`, expect: []int{0, 5}, exact: true},
+		{query: `/\(1\/2\)/`, expect: []int{5}, exact: true},
+		{query: `NOT (gc OR panic) AND session`, expect: []int{3, 5}},
+	}
+	for i, cas := range cases {
+		var expect []string
+		for _, j := range cas.expect {
+			item, err := sysutil.ParseLogItem(s.readTmpFileLine(t, "rpc.tidb.log", j))
+			require.NoError(t, err)
+			expect = append(expect, item.Message)
+		}
+		query, err := sysutil.ParseLogQuery(cas.query)
+		require.NoError(t, err, "case %d", i)
+
+		// evaluated by the server
+		s.searchOpts = []sysutil.SearchLogOption{sysutil.WithQuery(query)}
+		var got []string
+		for _, m := range s.searchLog(t, &pb.SearchLogRequest{}) {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, expect, got, "case %d", i)
+
+		// pushed down to the search request
+		s.searchOpts = nil
+		req := &pb.SearchLogRequest{}
+		require.Equal(t, cas.exact, query.PushDown(req), "case %d", i)
+		got = nil
+		for _, m := range s.searchLog(t, req) {
+			if cas.exact {
+				require.True(t, query.Match(m), "case %d", i)
+			}
+			if query.Match(m) {
+				got = append(got, m.Message)
+			}
+		}
+		require.Equal(t, expect, got, "case %d", i)
+	}
+}
+
+func TestParseLogQuery(t *testing.T) {
+	query, err := sysutil.ParseLogQuery(`level:error AND (region_id=42 OR "txn conflict") AND NOT gc`)
+	require.NoError(t, err)
+	req := &pb.SearchLogRequest{}
+	require.False(t, query.PushDown(req))
+	require.Equal(t, []pb.LogLevel{pb.LogLevel_Error}, req.Levels)
+	require.Equal(t, []string{`\[region_id=42\]`, "|txn conflict", "!gc"}, req.Patterns)
+
+	cases := []struct {
+		query  string
+		offset int
+		msg    string
+	}{
+		{query: ``, offset: 0, msg: `expected a term but got end of query`},
+		{query: `gc AND`, offset: 6, msg: `expected a term but got end of query`},
+		{query: `(gc OR panic`, offset: 12, msg: `expected ")" but got end of query`},
+		{query: `gc)`, offset: 2, msg: `unexpected ")"`},
+		{query: `OR gc`, offset: 0, msg: `expected a term but got "OR"`},
+		{query: `level:fatal`, offset: 6, msg: `unknown log level "fatal"`},
+		{query: `gc "txn`, offset: 3, msg: `unterminated quoted string`},
+		{query: `/txn`, offset: 0, msg: `unterminated regular expression`},
+		{query: `/(/`, offset: 0, msg: "error parsing regexp: missing closing ): `(`"},
+		{query: `=42`, offset: 0, msg: `missing field name`},
+		{query: `gc"txn"`, offset: 2, msg: `unexpected quote`},
+	}
+	for _, cas := range cases {
+		_, err := sysutil.ParseLogQuery(cas.query)
+		require.Error(t, err, cas.query)
+		syntaxErr, ok := err.(*sysutil.LogQuerySyntaxError)
+		require.True(t, ok, cas.query)
+		require.Equal(t, cas.offset, syntaxErr.Offset, cas.query)
+		require.Equal(t, cas.msg, syntaxErr.Msg, cas.query)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"google.golang.org/grpc/metadata"
+)
+
+// searchLogResult is an item read by LogSearch.produce, the entry is nil if
+// no new line has been appended in follow mode.
+type searchLogResult struct {
+	entry *LogEntry
+	err   error
+}
+
+// produce reads the items of the search until the search ends or the context
+// is canceled, the last result has the error, e.g. io.EOF.
+func (s *LogSearch) produce(ctx context.Context, results chan<- searchLogResult, done chan<- struct{}) {
+	defer close(done)
+	send := func(r searchLogResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			send(searchLogResult{err: searchLogPanicError(r)})
+		}
+	}()
+	for {
+		entry, err := s.next()
+		if err == errNoNewLog {
+			if !send(searchLogResult{}) {
+				return
+			}
+			if err = s.iter.wait(ctx); err == nil {
+				continue
+			}
+		}
+		if !send(searchLogResult{entry: entry, err: err}) || err != nil {
+			return
+		}
+	}
+}
+
+// searchLogStream sends the items of a search in batches limited by size, and
+// collects the stream trailer metadata.
+type searchLogStream struct {
+	stream         pb.Diagnostics_SearchLogServer
+	search         *LogSearch
+	batchSize      int
+	maxMessageSize int
+
+	// the batch to send
+	entries  []*LogEntry
+	messages []*pb.LogMessage
+	size     int
+
+	// The sources of the items and whether they are context items are
+	// run-length encoded
+	sources, kinds      []string
+	counts, kindCounts  []int
+	highlights, repeats []string
+	index               int // the position of the next item in the stream
+
+	// The highlights and the repeats are truncated at MaxSearchLogTrailerSize
+	trailerSize                           int
+	highlightsTruncated, repeatsTruncated bool
+}
+
+func (d *DiagnosticsServer) newSearchLogStream(stream pb.Diagnostics_SearchLogServer, search *LogSearch) *searchLogStream {
+	s := &searchLogStream{
+		stream:         stream,
+		search:         search,
+		batchSize:      d.batchSize,
+		maxMessageSize: d.maxMessageSize,
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = DefaultSearchLogBatchSize
+	}
+	if s.maxMessageSize == 0 {
+		s.maxMessageSize = DefaultMaxLogMessageSize
+	}
+	return s
+}
+
+func (d *DiagnosticsServer) searchLogFlushInterval() time.Duration {
+	if d.flushInterval > 0 {
+		return d.flushInterval
+	}
+	return DefaultSearchLogFlushInterval
+}
+
+// add appends the item to the batch, the batch is sent first if the item
+// cannot fit in.
+func (s *searchLogStream) add(entry *LogEntry) error {
+	message, highlights := entry.LogMessage, entry.Highlights
+	if s.maxMessageSize > 0 && len(message.Message) > s.maxMessageSize {
+		message, highlights = truncateLogMessage(message, highlights, s.maxMessageSize)
+	}
+	size := message.Size()
+	if len(s.messages) > 0 && s.size+size > s.batchSize {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, entry)
+	s.messages = append(s.messages, message)
+	s.size += size
+
+	if len(highlights) > 0 && !s.highlightsTruncated {
+		ranges := make([]string, len(highlights))
+		for i, r := range highlights {
+			ranges[i] = r.String()
+		}
+		value := fmt.Sprintf("%d:%s", s.index, strings.Join(ranges, ","))
+		if s.highlightsTruncated = !s.reserveTrailer(value); !s.highlightsTruncated {
+			s.highlights = append(s.highlights, value)
+		}
+	}
+	if entry.Repeats > 1 && !s.repeatsTruncated {
+		value := fmt.Sprintf("%d:%d:%d", s.index, entry.Repeats, entry.LastTime)
+		if s.repeatsTruncated = !s.reserveTrailer(value); !s.repeatsTruncated {
+			s.repeats = append(s.repeats, value)
+		}
+	}
+	s.index++
+	if n := len(s.sources); n > 0 && s.sources[n-1] == entry.Source {
+		s.counts[n-1]++
+	} else {
+		s.sources = append(s.sources, entry.Source)
+		s.counts = append(s.counts, 1)
+	}
+	kind := "match"
+	if entry.Context {
+		kind = "context"
+	}
+	if n := len(s.kinds); n > 0 && s.kinds[n-1] == kind {
+		s.kindCounts[n-1]++
+	} else {
+		s.kinds = append(s.kinds, kind)
+		s.kindCounts = append(s.kindCounts, 1)
+	}
+	return nil
+}
+
+// reserveTrailer reserves the size of the trailer value, it returns false if
+// the trailer would exceed MaxSearchLogTrailerSize.
+func (s *searchLogStream) reserveTrailer(value string) bool {
+	if s.trailerSize+len(value) > MaxSearchLogTrailerSize {
+		return false
+	}
+	s.trailerSize += len(value)
+	return true
+}
+
+// flush sends the batch if it isn't empty.
+func (s *searchLogStream) flush() error {
+	if len(s.messages) == 0 {
+		return nil
+	}
+	if err := s.stream.Send(&pb.SearchLogResponse{Messages: s.messages}); err != nil {
+		return err
+	}
+	// The cursor only covers the items sent
+	for _, entry := range s.entries {
+		s.search.track(entry)
+	}
+	s.entries, s.messages, s.size = nil, nil, 0
+	return nil
+}
+
+// setTrailer sets the stream trailer metadata after the search is drained.
+func (s *searchLogStream) setTrailer() {
+	trailer := metadata.MD{}
+	if s.search.Truncated() {
+		trailer.Set(SearchLogTruncatedKey, "true")
+	}
+	if s.search.tagged {
+		for i, source := range s.sources {
+			trailer.Append(SearchLogSourcesKey, fmt.Sprintf("%s:%d", source, s.counts[i]))
+		}
+	}
+	if s.search.iter.contextBefore > 0 || s.search.iter.contextAfter > 0 {
+		for i, kind := range s.kinds {
+			trailer.Append(SearchLogContextKey, fmt.Sprintf("%s:%d", kind, s.kindCounts[i]))
+		}
+	}
+	if len(s.highlights) > 0 {
+		trailer.Append(SearchLogHighlightsKey, s.highlights...)
+	}
+	if s.highlightsTruncated {
+		trailer.Set(SearchLogHighlightsTruncatedKey, "true")
+	}
+	if len(s.repeats) > 0 {
+		trailer.Append(SearchLogRepeatsKey, s.repeats...)
+	}
+	if s.repeatsTruncated {
+		trailer.Set(SearchLogRepeatsTruncatedKey, "true")
+	}
+	if trailer.Len() > 0 {
+		s.stream.SetTrailer(trailer)
+	}
+}
+
+// truncateLogMessage returns a copy of the message truncated to at most
+// maxSize bytes without breaking a UTF-8 character, followed by
+// LogMessageTruncatedMarker. The highlights are clipped as well.
+func truncateLogMessage(message *pb.LogMessage, highlights []LogRange, maxSize int) (*pb.LogMessage, []LogRange) {
+	n := maxSize
+	for n > 0 && !utf8.RuneStart(message.Message[n]) {
+		n--
+	}
+	truncated := &pb.LogMessage{
+		Time:    message.Time,
+		Level:   message.Level,
+		Message: message.Message[:n] + LogMessageTruncatedMarker,
+	}
+	var clipped []LogRange
+	for _, r := range highlights {
+		if r.Start >= n {
+			break
+		}
+		if r.End > n {
+			r.End = n
+		}
+		clipped = append(clipped, r)
+	}
+	return truncated, clipped
+}
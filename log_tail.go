@@ -0,0 +1,159 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultFollowInterval is the default interval to poll the active log file
+// for newly appended lines in follow mode.
+const DefaultFollowInterval = time.Second
+
+// errNoNewLog is returned by the iterator in follow mode if all the lines
+// written so far have been read.
+var errNoNewLog = errors.New("no new log")
+
+// logTail reads the lines appended to the active log file, and follows the
+// file to the new one after it's rotated.
+type logTail struct {
+	path    string
+	file    *os.File // nil if the active file doesn't exist
+	reader  *bufio.Reader
+	partial []byte   // the line being written
+	rotated *os.File // the new active file after rotation
+	// wrap wraps the files read after rotation or truncation, e.g. to
+	// throttle the reads
+	wrap func(io.Reader) io.Reader
+}
+
+// newLogTail creates a logTail reading the active log file from the current
+// position of reader. The file may be nil if the active file doesn't exist.
+func newLogTail(path string, file *os.File, reader *bufio.Reader, wrap func(io.Reader) io.Reader) *logTail {
+	return &logTail{
+		path:   path,
+		file:   file,
+		reader: reader,
+		wrap:   wrap,
+	}
+}
+
+// readLine reads the next complete line, io.EOF is returned if no complete
+// line has been appended yet.
+func (t *logTail) readLine() (string, error) {
+	for {
+		if t.file != nil {
+			b, err := t.reader.ReadBytes('\n')
+			t.partial = append(t.partial, b...)
+			if err == nil {
+				return t.takeLine(), nil
+			}
+			if err != io.EOF {
+				return "", err
+			}
+		}
+		if t.rotated != nil {
+			// No more lines will be written to the old file
+			if len(t.partial) > 0 {
+				return t.takeLine(), nil
+			}
+			if t.file != nil {
+				_ = t.file.Close()
+			}
+			t.file, t.rotated = t.rotated, nil
+			t.reader = bufio.NewReader(t.wrap(t.file))
+			continue
+		}
+		reopened, err := t.checkRotation()
+		if err != nil {
+			return "", err
+		}
+		if !reopened {
+			return "", io.EOF
+		}
+	}
+}
+
+func (t *logTail) takeLine() string {
+	line := strings.TrimRight(string(t.partial), "\r\n")
+	t.partial = t.partial[:0]
+	return line
+}
+
+// checkRotation checks whether the active log file has been renamed by the
+// rotation, or truncated by copytruncate. It returns true if the file needs
+// to be read again.
+func (t *logTail) checkRotation() (bool, error) {
+	stat, err := os.Stat(t.path)
+	// The active file has been renamed but the new one hasn't been created
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if t.file == nil {
+		return t.openRotated()
+	}
+	current, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(stat, current) {
+		return t.openRotated()
+	}
+	offset, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	if current.Size() >= offset {
+		return false, nil
+	}
+	// The file has been truncated, read it from the start
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	t.reader.Reset(t.wrap(t.file))
+	t.partial = t.partial[:0]
+	return true, nil
+}
+
+// openRotated opens the new active file, which is read after the rest of the
+// old one.
+func (t *logTail) openRotated() (bool, error) {
+	file, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t.rotated = file
+	return true, nil
+}
+
+func (t *logTail) close() {
+	if t.file != nil {
+		_ = t.file.Close()
+	}
+	if t.rotated != nil {
+		_ = t.rotated.Close()
+	}
+}
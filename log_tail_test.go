@@ -0,0 +1,189 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestFollowSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	appendLog := func(content string) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(content)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	s.writeTmpFile(t, "rpc.tidb-2019-08-26T06-19-20.000.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [ERROR] [misc.go:91] ["panic 1"]`,
+	})
+	appendLog(`[2019/08/26 06:20:13.011 -04:00] [ERROR] [misc.go:91] ["panic 2"]` + "\n")
+
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFollow(10 * time.Millisecond)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pb.NewDiagnosticsClient(conn).SearchLog(ctx, &pb.SearchLogRequest{
+		Levels: []pb.LogLevel{pb.LogLevel_Error},
+	})
+	require.NoError(t, err)
+	recv := func(n int) []string {
+		var got []string
+		for len(got) < n {
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			for _, m := range res.Messages {
+				got = append(got, m.Message)
+			}
+		}
+		return got
+	}
+
+	// the existing logs
+	require.Equal(t, []string{`[misc.go:91] ["panic 1"]`, `[misc.go:91] ["panic 2"]`}, recv(2))
+
+	// the line is returned after it's completely written
+	appendLog(`[2019/08/26 06:21:13.011 -04:00] [ERROR] `)
+	time.Sleep(50 * time.Millisecond)
+	appendLog(`[misc.go:91] ["panic 3"]` + "\n")
+	appendLog(`[2019/08/26 06:21:14.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]` + "\n")
+	appendLog(`[2019/08/26 06:21:15.011 -04:00] [ERROR] [misc.go:91] ["panic 4"]` + "\n")
+	require.Equal(t, []string{`[misc.go:91] ["panic 3"]`, `[misc.go:91] ["panic 4"]`}, recv(2))
+
+	// rotated by renaming
+	appendLog(`[2019/08/26 06:22:13.011 -04:00] [ERROR] [misc.go:91] ["panic 5"]` + "\n")
+	require.NoError(t, os.Rename(path, filepath.Join(s.tmpDir, "rpc.tidb-2019-08-26T06-22-20.000.log")))
+	time.Sleep(50 * time.Millisecond)
+	appendLog(`[2019/08/26 06:23:13.011 -04:00] [ERROR] [misc.go:91] ["panic 6"]` + "\n")
+	require.Equal(t, []string{`[misc.go:91] ["panic 5"]`, `[misc.go:91] ["panic 6"]`}, recv(2))
+
+	// rotated by copytruncate
+	require.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	appendLog(`[2019/08/26 06:24:13.011 -04:00] [ERROR] [misc.go:91] ["panic 7"]` + "\n")
+	require.Equal(t, []string{`[misc.go:91] ["panic 7"]`}, recv(1))
+
+	// ends when the client cancels the stream
+	cancel()
+	_, err = stream.Recv()
+	require.Equal(t, codes.Canceled, status.Code(err))
+
+	// cannot follow in reverse
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFollow(0), sysutil.WithReverse()}
+	stream, err = pb.NewDiagnosticsClient(conn).SearchLog(context.Background(), &pb.SearchLogRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Error(t, err)
+}
+
+// searchLogStream is a SearchLog stream that drops the responses.
+type searchLogStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s searchLogStream) Context() context.Context         { return s.ctx }
+func (s searchLogStream) Send(*pb.SearchLogResponse) error { return nil }
+func (s searchLogStream) SetTrailer(metadata.MD)           {}
+
+func TestCancelFollowSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+	})
+	server := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"))
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		done := make(chan error, 1)
+		go func() {
+			done <- server.SearchLogWithOptions(&pb.SearchLogRequest{}, searchLogStream{ctx: ctx}, sysutil.WithFollow(10*time.Millisecond))
+		}()
+		select {
+		case err := <-done:
+			require.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the canceled search doesn't return")
+		}
+		cancel()
+	}
+}
+
+func TestFollowMultilineLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	appendLog := func(content string) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(content)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	appendLog(`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]` + "\n")
+
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFollow(100 * time.Millisecond), sysutil.WithMultilineAggregation(0)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pb.NewDiagnosticsClient(conn).SearchLog(ctx, &pb.SearchLogRequest{
+		Patterns: []string{"panic"},
+	})
+	require.NoError(t, err)
+	recv := func() string {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, res.Messages, 1)
+		return res.Messages[0].Message
+	}
+
+	// the continuation lines written within a poll interval are aggregated
+	for i := 0; i < 2; i++ {
+		appendLog(fmt.Sprintf(`[2019/08/26 06:20:1%d.011 -04:00] [ERROR] [misc.go:91] ["panic %d"]`, i, i) + "\n")
+		time.Sleep(60 * time.Millisecond)
+		appendLog(fmt.Sprintf("goroutine %d [running]:\n", i))
+		require.Equal(t, fmt.Sprintf("[misc.go:91] [\"panic %d\"]\ngoroutine %d [running]:", i, i), recv())
+	}
+}
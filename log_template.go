@@ -0,0 +1,181 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+// LogTemplateWildcard is the token of a LogTemplate which stands for the
+// variable parts of the messages, e.g. numbers and IDs.
+const LogTemplateWildcard = "<*>"
+
+// templateSimilarity is the minimum ratio of the equal tokens to merge a
+// message into a template.
+const templateSimilarity = 0.5
+
+// templateVariableRegexp matches the variable parts of the tokens, i.e. UUIDs,
+// hex numbers, hex strings like digests and decimal numbers.
+var templateVariableRegexp = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|0[xX][0-9a-fA-F]+|[0-9a-fA-F]{16,}|[0-9]+(\.[0-9]+)?`)
+
+// maskLogVariables replaces the variable parts of s by LogTemplateWildcard.
+func maskLogVariables(s string) string {
+	return templateVariableRegexp.ReplaceAllLiteralString(s, LogTemplateWildcard)
+}
+
+// LogTemplate is the shape of the log messages which differ only in variable
+// parts, e.g. `[region_cache.go:<*>] ["region epoch not match"] [region_id=<*>]`.
+type LogTemplate struct {
+	// Template is the tokens of the messages separated by spaces, in which
+	// the variable parts are LogTemplateWildcard.
+	Template string
+	Count    int64
+	// FirstSeen and LastSeen are the time of the earliest and the latest
+	// messages in unix milliseconds.
+	FirstSeen int64
+	LastSeen  int64
+	// Example is the first message of the template read by the search.
+	Example string
+
+	tokens []string
+}
+
+func (t *LogTemplate) add(item *pb.LogMessage) {
+	if t.Count == 0 || item.Time < t.FirstSeen {
+		t.FirstSeen = item.Time
+	}
+	if t.Count == 0 || item.Time > t.LastSeen {
+		t.LastSeen = item.Time
+	}
+	t.Count++
+}
+
+// similarity returns the ratio of the tokens equal to the template, the
+// wildcards of the template are not counted.
+func (t *LogTemplate) similarity(tokens []string) float64 {
+	if len(tokens) == 0 {
+		return 1
+	}
+	var equal int
+	for i, token := range tokens {
+		if t.tokens[i] == token && token != LogTemplateWildcard {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(tokens))
+}
+
+// merge replaces the tokens of the template different from the message by
+// the wildcard.
+func (t *LogTemplate) merge(tokens []string) {
+	changed := false
+	for i, token := range tokens {
+		if t.tokens[i] != token && t.tokens[i] != LogTemplateWildcard {
+			t.tokens[i] = LogTemplateWildcard
+			changed = true
+		}
+	}
+	if changed {
+		t.Template = strings.Join(t.tokens, " ")
+	}
+}
+
+// logTemplateMiner clusters the log messages into templates like Drain, see
+// "Drain: An Online Log Parsing Approach with Fixed Depth Tree". The messages
+// are tokenized by spaces with the variable parts masked, grouped by the
+// number of tokens and the first token, and merged into the most similar
+// template of the group.
+type logTemplateMiner struct {
+	groups map[string][]*LogTemplate
+}
+
+func (m *logTemplateMiner) add(item *pb.LogMessage) {
+	// the continuation lines, e.g. stack traces, are not tokenized
+	tokens := strings.Fields(firstLine(item.Message))
+	for i, token := range tokens {
+		tokens[i] = maskLogVariables(token)
+	}
+	key := strconv.Itoa(len(tokens))
+	if len(tokens) > 0 {
+		key += " " + tokens[0]
+	}
+
+	var best *LogTemplate
+	var bestSimilarity float64
+	for _, t := range m.groups[key] {
+		if s := t.similarity(tokens); best == nil || s > bestSimilarity {
+			best, bestSimilarity = t, s
+		}
+	}
+	if best == nil || bestSimilarity < templateSimilarity {
+		best = &LogTemplate{
+			Template: strings.Join(tokens, " "),
+			Example:  item.Message,
+			tokens:   tokens,
+		}
+		m.groups[key] = append(m.groups[key], best)
+	} else {
+		best.merge(tokens)
+	}
+	best.add(item)
+}
+
+// MineLogTemplates clusters the log items matched by the search request into
+// templates, and returns the top n templates ordered by count. All templates
+// are returned if n <= 0. The items are searched as an aggregation described
+// by NewLogSearch.
+func (d *DiagnosticsServer) MineLogTemplates(ctx context.Context, req *pb.SearchLogRequest, n int, opts ...SearchLogOption) ([]*LogTemplate, error) {
+	search, err := d.newAggregatedSearch(ctx, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer search.Close()
+
+	miner := &logTemplateMiner{groups: make(map[string][]*LogTemplate)}
+	for {
+		entry, err := search.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !entry.Context {
+			miner.add(entry.LogMessage)
+		}
+	}
+
+	var results []*LogTemplate
+	for _, group := range miner.groups {
+		results = append(results, group...)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Template < results[j].Template
+	})
+	if n > 0 && len(results) > n {
+		results = results[:n]
+	}
+	return results, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMineLogTemplates(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=42]`,
+		`[2019/08/26 06:19:15.011 -04:00] [INFO] [session.go:1014] ["execute sql"] [conn=1] [user=root]`,
+		`[2019/08/26 06:19:16.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=43]`,
+		`[2019/08/26 06:19:17.011 -04:00] [INFO] [session.go:1014] ["execute sql"] [conn=2] [user=admin]`,
+		`[2019/08/26 06:19:18.011 -04:00] [INFO] [session.go:1014] ["execute sql"] [conn=3]`,
+		`[2019/08/26 06:19:19.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=0x2a]`,
+		`[2019/08/26 06:19:20.011 -04:00] [ERROR] [txn.go:98] ["txn conflict"] [start_ts=0f3c7e2a9d4b1c6e8a]`,
+		`[2019/08/26 06:19:21.011 -04:00] [ERROR] [txn.go:98] ["txn conflict"] [start_ts=0d6a1e4b2c9f3e8a7b]`,
+		`[2019/08/26 06:19:22.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=44]`,
+		`[2019/08/26 06:19:23.011 -04:00] [WARN] [region_cache.go:121] ["region version not match"] [region_id=45]`,
+	})
+
+	type template struct {
+		template  string
+		count     int64
+		firstSeen int64
+		lastSeen  int64
+		example   string
+	}
+	mine := func(req *pb.SearchLogRequest, n int, opts ...sysutil.SearchLogOption) []template {
+		d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"), sysutil.WithSearchLogLimit(1))
+		results, err := d.MineLogTemplates(context.Background(), req, n, opts...)
+		require.NoError(t, err)
+		var templates []template
+		for _, r := range results {
+			templates = append(templates, template{r.Template, r.Count, r.FirstSeen, r.LastSeen, r.Example})
+		}
+		return templates
+	}
+
+	require.Equal(t, []template{
+		// merged as the messages differ only in a word
+		{`[region_cache.go:<*>] ["region <*> not match"] [region_id=<*>]`, 5, s.itemTime(t, "rpc.tidb.log", 1), s.itemTime(t, "rpc.tidb.log", 10), `[region_cache.go:120] ["region epoch not match"] [region_id=42]`},
+		{`[session.go:<*>] ["execute sql"] [conn=<*>] <*>`, 2, s.itemTime(t, "rpc.tidb.log", 2), s.itemTime(t, "rpc.tidb.log", 4), `[session.go:1014] ["execute sql"] [conn=1] [user=root]`},
+		{`[txn.go:<*>] ["txn conflict"] [start_ts=<*>]`, 2, s.itemTime(t, "rpc.tidb.log", 7), s.itemTime(t, "rpc.tidb.log", 8), `[txn.go:98] ["txn conflict"] [start_ts=0f3c7e2a9d4b1c6e8a]`},
+	}, mine(&pb.SearchLogRequest{}, 3))
+
+	// filtered by the search request
+	require.Equal(t, []template{
+		{`[region_cache.go:<*>] ["region epoch not match"] [region_id=<*>]`, 2, s.itemTime(t, "rpc.tidb.log", 6), s.itemTime(t, "rpc.tidb.log", 9), `[region_cache.go:120] ["region epoch not match"] [region_id=44]`},
+		{`[txn.go:<*>] ["txn conflict"] [start_ts=<*>]`, 2, s.itemTime(t, "rpc.tidb.log", 7), s.itemTime(t, "rpc.tidb.log", 8), `[txn.go:98] ["txn conflict"] [start_ts=0d6a1e4b2c9f3e8a7b]`},
+	}, mine(&pb.SearchLogRequest{StartTime: s.itemTime(t, "rpc.tidb.log", 6), EndTime: s.itemTime(t, "rpc.tidb.log", 9)}, 0, sysutil.WithReverse(), sysutil.WithContext(1, 1)))
+
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"))
+	_, err := d.MineLogTemplates(context.Background(), &pb.SearchLogRequest{}, 0, sysutil.WithFollow(0))
+	require.Error(t, err)
+	_, err = d.MineLogTemplates(context.Background(), &pb.SearchLogRequest{}, 0, sysutil.WithDedup(0))
+	require.Error(t, err)
+}
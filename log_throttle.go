@@ -0,0 +1,169 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleBurst is the time of work that the limiters allow at once
+	throttleBurst = 100 * time.Millisecond
+	// throttleQuantum is the busy time of a cursor charged to the duty cycle
+	// at a time, so that the limiter isn't locked for every item
+	throttleQuantum = 10 * time.Millisecond
+)
+
+// rateLimiter is a token bucket shared by the log searches of a server. The
+// tokens may be in debt, and the callers wait until the debt is paid off.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // the tokens refilled per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := rate * throttleBurst.Seconds()
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, and blocks until they are refilled if the bucket is in
+// debt. It returns the time waited.
+func (l *rateLimiter) wait(ctx context.Context, n float64) (time.Duration, error) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= n
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// logThrottle limits the resources taken by the log searches of a server, a
+// nil limiter means unlimited.
+type logThrottle struct {
+	// readRate limits the bytes read from the log files per second
+	readRate *rateLimiter
+	// dutyCycle limits the busy time of the cursors per second
+	dutyCycle *rateLimiter
+}
+
+// cursorThrottle charges the bytes read and the time taken by a cursor to the
+// limiters of the server.
+type cursorThrottle struct {
+	limits   *logThrottle // nil if unlimited
+	counting bool         // whether the busy time is being counted
+	busy     time.Duration
+	mark     time.Time // the start of the busy time not counted yet
+}
+
+// start starts to count the busy time of the cursor.
+func (t *cursorThrottle) start() {
+	if t.limits != nil && t.limits.dutyCycle != nil {
+		t.counting = true
+		t.mark = time.Now()
+	}
+}
+
+// stop stops counting the busy time, e.g. while the cursor waits for the
+// consumer of the items.
+func (t *cursorThrottle) stop() {
+	if t.counting {
+		t.busy += time.Since(t.mark)
+		t.counting = false
+	}
+}
+
+// pause blocks the cursor to keep the duty cycle once it has been busy for
+// throttleQuantum. It does nothing if the busy time isn't being counted.
+func (t *cursorThrottle) pause(ctx context.Context) error {
+	if !t.counting {
+		return nil
+	}
+	now := time.Now()
+	t.busy += now.Sub(t.mark)
+	t.mark = now
+	if t.busy < throttleQuantum {
+		return nil
+	}
+	busy := t.busy
+	t.busy = 0
+	_, err := t.limits.dutyCycle.wait(ctx, busy.Seconds())
+	t.mark = time.Now()
+	return err
+}
+
+// read blocks the cursor to keep the read rate after n bytes are read, the
+// time waited isn't counted as busy.
+func (t *cursorThrottle) read(ctx context.Context, n int) error {
+	if t.limits == nil || t.limits.readRate == nil || n <= 0 {
+		return nil
+	}
+	waited, err := t.limits.readRate.wait(ctx, float64(n))
+	if t.counting {
+		t.busy -= waited
+	}
+	return err
+}
+
+// reader returns a reader throttled by the read rate.
+func (t *cursorThrottle) reader(ctx context.Context, r io.Reader) io.Reader {
+	if t.limits == nil || t.limits.readRate == nil {
+		return r
+	}
+	return &throttledReader{r: r, ctx: ctx, throttle: t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	ctx      context.Context
+	throttle *cursorThrottle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.throttle.read(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
@@ -17,25 +17,33 @@ package sysutil
 import (
 	"bufio"
 	"compress/gzip"
+	"container/heap"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
 )
 
 type logFile struct {
-	file       *os.File // The opened file handle
-	begin, end int64    // The timesteamp in millisecond of first line
-	compressed bool     // The file is compressed or not
+	file        *os.File        // The opened file handle
+	begin, end  int64           // The timesteamp in millisecond of first line
+	compressed  bool            // The file is compressed or not
+	checkpoints []logCheckpoint // The checkpoints of compressed file
+	parser      LogParser       // The parser of the log format
+	source      string          // The name of the log source
+	resume      *filePosition   // The position to resume reading, see WithCursor
 }
 
 func (l *logFile) BeginTime() int64 {
@@ -48,11 +56,34 @@ func (l *logFile) EndTime() int64 {
 
 const compressSuffix = ".gz"
 
-func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime int64) ([]logFile, error) {
+// lumberjackTimeFormat is the time format in the names of the backup files
+// rotated by lumberjack, e.g. tidb-2019-08-26T07-19-49.529.log.gz
+const lumberjackTimeFormat = "2006-01-02T15-04-05.000"
+
+// parseRotationTime parses the rotation time in unix milliseconds from the
+// name of the backup file rotated by lumberjack with local time.
+func parseRotationTime(path, filePrefix, ext string) (int64, bool) {
+	name := strings.TrimSuffix(strings.TrimSuffix(path, compressSuffix), ext)
+	if !strings.HasPrefix(name, filePrefix+"-") {
+		return 0, false
+	}
+	t, err := time.ParseInLocation(lumberjackTimeFormat, name[len(filePrefix)+1:], time.Local)
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixNano() / int64(time.Millisecond), true
+}
+
+// resolveFiles opens the log files of logFilePath which may have items in
+// the time range. The reads of the files are charged to the throttle.
+func resolveFiles(ctx context.Context, logFilePath string, parser LogParser, beginTime, endTime int64, throttle *cursorThrottle) ([]logFile, error) {
 	if logFilePath == "" {
 		return nil, errors.New("empty log file location configuration")
 	}
+	throttle.start()
+	defer throttle.stop()
 
+	tryLines := validLogTryLines(parser)
 	var logFiles []logFile
 	var skipFiles []*os.File
 	logDir := filepath.Dir(logFilePath)
@@ -70,6 +101,11 @@ func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime in
 		if !strings.HasPrefix(path, filePrefix) {
 			return nil
 		}
+		// Remove the index of the compressed log files which have been purged
+		if strings.HasSuffix(path, ext+compressSuffix+logIndexSuffix) {
+			removeStaleLogIndex(path)
+			return nil
+		}
 		compressed := strings.HasSuffix(path, compressSuffix)
 		if !strings.HasSuffix(path, ext) && !strings.HasSuffix(path, ext+compressSuffix) {
 			return nil
@@ -77,6 +113,9 @@ func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime in
 		if isCtxDone(ctx) {
 			return ctx.Err()
 		}
+		if err := throttle.pause(ctx); err != nil {
+			return err
+		}
 		// If we cannot open the file, we skip to search the file instead of returning
 		// error and abort entire searching task.
 		// TODO: do we need to return some warning to client?
@@ -84,36 +123,50 @@ func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime in
 		if err != nil {
 			return nil
 		}
-		var reader *bufio.Reader
+		// The rotation time of the backup file is not earlier than its last item.
+		rotationTime, rotated := parseRotationTime(path, filePrefix, ext)
+		var firstItemTime, lastItemTime int64
+		var checkpoints []logCheckpoint
 		if !compressed {
-			reader = bufio.NewReader(file)
+			firstItem, err := readFirstValidLog(ctx, bufio.NewReader(throttle.reader(ctx, file)), parser, int64(tryLines))
+			if err != nil {
+				skipFiles = append(skipFiles, file)
+				return nil
+			}
+			firstItemTime = firstItem.Time
+			lastItem, err := readLastValidLog(ctx, file, parser, tryLines, throttle)
+			// Sanity check the last item by the rotation time, the tail of file
+			// may be broken or have too many continuation lines.
+			if rotated && rotationTime >= firstItemTime && (err != nil || lastItem.Time < firstItemTime) {
+				lastItemTime = rotationTime
+			} else if err != nil {
+				skipFiles = append(skipFiles, file)
+				return nil
+			} else {
+				lastItemTime = lastItem.Time
+			}
+		} else if index, err := loadLogIndex(path, file); err == nil {
+			firstItemTime, lastItemTime = index.First, index.Last
+			checkpoints = index.Checkpoints
 		} else {
-			gr, err := gzip.NewReader(file)
+			gr, err := gzip.NewReader(throttle.reader(ctx, file))
 			if err != nil {
+				skipFiles = append(skipFiles, file)
 				return nil
 			}
-			reader = bufio.NewReader(gr)
-		}
-
-		var firstItemTime, lastItemTime int64
-		firstItem, err := readFirstValidLog(ctx, reader, 10)
-		if err != nil {
-			skipFiles = append(skipFiles, file)
-			return nil
-		}
-		firstItemTime = firstItem.Time
-
-		if !compressed {
-			lastItem, err := readLastValidLog(ctx, file, 10)
+			firstItem, err := readFirstValidLog(ctx, bufio.NewReader(gr), parser, int64(tryLines))
 			if err != nil {
 				skipFiles = append(skipFiles, file)
 				return nil
 			}
-			lastItemTime = lastItem.Time
-		} else {
-			// For compressed file, it's hard to get last item,
-			// and to avoid decompression, we assume lastTime equals to `math.MaxInt64`.
+			// For compressed file, it's hard to get last item. The file is
+			// pruned by the rotation time, and its index is built once it's
+			// read out by a search.
+			firstItemTime = firstItem.Time
 			lastItemTime = math.MaxInt64
+			if rotated && rotationTime >= firstItemTime {
+				lastItemTime = rotationTime
+			}
 		}
 		// Reset position to the start and skip this file if cannot seek to start
 		if _, err := file.Seek(0, io.SeekStart); err != nil {
@@ -125,10 +178,12 @@ func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime in
 			skipFiles = append(skipFiles, file)
 		} else {
 			logFiles = append(logFiles, logFile{
-				file:       file,
-				begin:      firstItemTime,
-				end:        lastItemTime,
-				compressed: compressed,
+				file:        file,
+				begin:       firstItemTime,
+				end:         lastItemTime,
+				compressed:  compressed,
+				checkpoints: checkpoints,
+				parser:      parser,
 			})
 		}
 		return nil
@@ -151,21 +206,17 @@ func resolveFiles(ctx context.Context, logFilePath string, beginTime, endTime in
 		return logFiles[i].begin < logFiles[j].begin
 	})
 
-	// Assume no time range overlap in log files and remove unnecessary log files for compressed files.
-	// When logFiles[i-1].end < begin < logFiles[i].begin, it will return one more logFiles[i-1].
-	idx := 0
-	for i := range logFiles {
-		if i == 0 {
-			continue
-		}
-		if logFiles[i].begin < beginTime {
-			idx = i
-			skipFiles = append(skipFiles, logFiles[i-1].file)
-		} else {
-			break
-		}
+	return logFiles, err
+}
+
+// validLogTryLines returns the number of lines to try when looking for a
+// valid log item.
+func validLogTryLines(parser LogParser) int {
+	// The items of multi-line logs have lots of continuation lines.
+	if isMultiline(parser) {
+		return 1024
 	}
-	return logFiles[idx:], err
+	return 10
 }
 
 func isCtxDone(ctx context.Context) bool {
@@ -177,14 +228,14 @@ func isCtxDone(ctx context.Context) bool {
 	}
 }
 
-func readFirstValidLog(ctx context.Context, reader *bufio.Reader, tryLines int64) (*pb.LogMessage, error) {
+func readFirstValidLog(ctx context.Context, reader *bufio.Reader, parser LogParser, tryLines int64) (*pb.LogMessage, error) {
 	var tried int64
 	for {
 		line, err := readLine(reader)
 		if err != nil {
 			return nil, err
 		}
-		item, err := parseLogItem(line)
+		item, err := parser.ParseLogItem(line)
 		if err == nil {
 			return item, nil
 		}
@@ -199,7 +250,7 @@ func readFirstValidLog(ctx context.Context, reader *bufio.Reader, tryLines int64
 	return nil, errors.New("not a valid log file")
 }
 
-func readLastValidLog(ctx context.Context, file *os.File, tryLines int) (*pb.LogMessage, error) {
+func readLastValidLog(ctx context.Context, file *os.File, parser LogParser, tryLines int, throttle *cursorThrottle) (*pb.LogMessage, error) {
 	var tried int
 	stat, _ := file.Stat()
 	endCursor := stat.Size()
@@ -212,9 +263,12 @@ func readLastValidLog(ctx context.Context, file *os.File, tryLines int) (*pb.Log
 		if readBytes == 0 {
 			break
 		}
+		if err := throttle.read(ctx, readBytes); err != nil {
+			return nil, err
+		}
 		endCursor -= int64(readBytes)
 		for i := len(lines) - 1; i >= 0; i-- {
-			item, err := parseLogItem(lines[i])
+			item, err := parser.ParseLogItem(lines[i])
 			if err == nil {
 				return item, nil
 			}
@@ -244,6 +298,45 @@ func readLine(reader *bufio.Reader) (string, error) {
 
 const maxReadCacheSize = 1024 * 1024 * 16
 
+// seekThreshold is the size of the range to stop bisecting and scan lines.
+const seekThreshold = 64 * 1024
+
+// seekToTime bisects the time-ordered log file and returns an offset, from
+// which all the items not earlier than ts can be read after skipping the
+// partial line at the offset. The items before the offset are earlier than
+// ts. The reads of the file are charged to the throttle.
+func seekToTime(ctx context.Context, file *os.File, parser LogParser, ts int64, throttle *cursorThrottle) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	lo, hi := int64(0), stat.Size()
+	for hi-lo > seekThreshold {
+		if isCtxDone(ctx) {
+			return 0, ctx.Err()
+		}
+		if err := throttle.pause(ctx); err != nil {
+			return 0, err
+		}
+		mid := lo + (hi-lo)/2
+		reader := bufio.NewReader(throttle.reader(ctx, io.NewSectionReader(file, mid, stat.Size()-mid)))
+		// skip the partial line
+		if _, err := readLine(reader); err != nil {
+			hi = mid
+			continue
+		}
+		item, err := readFirstValidLog(ctx, reader, parser, int64(validLogTryLines(parser)))
+		// Only move the lower bound if we are sure all items before
+		// mid are earlier than ts.
+		if err == nil && item.Time < ts {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
 // Read lines from the end of a file
 // endCursor initial value should be the file size
 func readLastLines(ctx context.Context, file *os.File, endCursor int64) ([]string, int, error) {
@@ -333,6 +426,9 @@ func ParseLogLevel(s string) pb.LogLevel {
 // [2019/08/21 01:43:01.460 -04:00] [INFO] [util.go:60] [PD] [release-version=v3.0.2]
 // [2019/08/26 07:20:23.815 -04:00] [INFO] [mod.rs:28] ["Release Version:   3.0.2"]
 func parseLogItem(s string) (*pb.LogMessage, error) {
+	if len(s) < timeStampLayoutLen {
+		return nil, fmt.Errorf("invalid log string: %s", s)
+	}
 	timeLeftBound := strings.Index(s, "[")
 	timeRightBound := strings.Index(s, "]")
 	if timeLeftBound == -1 || timeRightBound == -1 || timeLeftBound > timeRightBound {
@@ -374,106 +470,909 @@ func parseTimeStamp(s string) (int64, error) {
 
 // logIterator implements Iterator and IteratorWithPeek interface.
 // It's used for reading logs from log files one by one by their
-// time.
+// time. The items of the files are merged by their time, so the
+// files may overlap in time range, e.g. copied or restored logs.
 type logIterator struct {
 	// filters
-	begin     int64
-	end       int64
-	levelFlag int64
-	patterns  []*regexp.Regexp
+	begin        int64
+	end          int64
+	levelFlag    int64
+	patterns     [][]logPattern // the conjunction of the disjunctions
+	fieldFilters []LogField
+	query        *LogQuery
+	// highlighted reports the byte ranges matched by the filters
+	highlighted bool
+	// multiline merges continuation lines into the preceding item, and
+	// the lines beyond maxRecordSize bytes are dropped with a marker. It's always
+	// enabled for the files of MultilineLogParser.
+	multiline     bool
+	maxRecordSize int
+	// reverse walks the files newest-first and reads lines backwards
+	reverse bool
+	// contextBefore and contextAfter are the numbers of the context items
+	// returned before and after the matched items in the file order
+	contextBefore int
+	contextAfter  int
+
+	// follow keeps reading the lines appended to the active log files of
+	// the sources after the pending files are read out
+	follow         []LogSource
+	followInterval time.Duration
+	// parallelism is the maximum number of files scanned in background
+	parallelism int
+	// throttle limits the read rate and the duty cycle of the scans, nil if
+	// unlimited
+	throttle *logThrottle
 
 	// inner state
-	fileIndex int
-	reader    *bufio.Reader
 	pending   []logFile
-	preLog    *pb.LogMessage
+	order     []int           // the order to open the pending files
+	fileIndex int             // the number of the opened pending files
+	cursors   logCursorHeap   // the opened files ordered by their head items
+	idle      []*logCursor    // the followed files without new lines
+	following map[string]bool // the sources whose active files are followed
+
+	// background scans
+	started int          // the number of the started pending files
+	ahead   []*logCursor // the files started but not opened yet
+	running int32        // the number of the running scans
+	scanCtx context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 }
 
 // The Close method close all resources the iterator has.
 func (iter *logIterator) close() {
+	// The files are read by the background scans
+	if iter.cancel != nil {
+		iter.cancel()
+		iter.wg.Wait()
+	}
 	for _, f := range iter.pending {
 		_ = f.file.Close()
 	}
+	for _, c := range iter.cursors.cursors {
+		c.close()
+	}
+	for _, c := range iter.idle {
+		c.close()
+	}
 }
 
-func (iter *logIterator) updateToNextReader() error {
-	if !iter.pending[iter.fileIndex].compressed {
-		iter.reader = bufio.NewReader(iter.pending[iter.fileIndex].file)
-	} else {
-		gr, err := gzip.NewReader(iter.pending[iter.fileIndex].file)
+// match checks whether the item satisfies the filters except the time range.
+func (iter *logIterator) match(item *pb.LogMessage) bool {
+	// always keep unknown log_level
+	if item.Level > pb.LogLevel_UNKNOWN && iter.levelFlag != 0 && iter.levelFlag&(1<<item.Level) == 0 {
+		return false
+	}
+	for _, group := range iter.patterns {
+		if !matchAny(item.Message, group) {
+			return false
+		}
+	}
+	if len(iter.fieldFilters) > 0 && !matchFields(item.Message, iter.fieldFilters) {
+		return false
+	}
+	if iter.query != nil && !iter.query.Match(item) {
+		return false
+	}
+	return true
+}
+
+// next reads the next matched log item from the pending files. The items of
+// all files are merged by their time, and a file is opened only if it may
+// have items earlier than the head items of the opened files, so at most one
+// file is open if the files don't overlap in time range, except the files
+// scanned in background ahead of time.
+func (iter *logIterator) next(ctx context.Context) (*LogEntry, error) {
+	if iter.order == nil {
+		iter.order = make([]int, len(iter.pending))
+		for i := range iter.order {
+			iter.order[i] = i
+		}
+		// The files are opened by start time, and by end time in reverse mode
+		sort.SliceStable(iter.order, func(i, j int) bool {
+			lhs, rhs := iter.pending[iter.order[i]], iter.pending[iter.order[j]]
+			if iter.reverse {
+				return lhs.end > rhs.end
+			}
+			return lhs.begin < rhs.begin
+		})
+		iter.cursors.reverse = iter.reverse
+	}
+
+	iter.prefetchAhead(ctx)
+	for iter.fileIndex < len(iter.order) {
+		f := iter.pending[iter.order[iter.fileIndex]]
+		if iter.cursors.Len() > 0 {
+			head := iter.cursors.cursors[0].head
+			if (!iter.reverse && f.begin > head.Time) || (iter.reverse && f.end < head.Time) {
+				break
+			}
+		}
+		var c *logCursor
+		if len(iter.ahead) > 0 {
+			c, iter.ahead = iter.ahead[0], iter.ahead[1:]
+		} else {
+			var err error
+			if c, err = iter.openCursor(ctx, iter.order[iter.fileIndex]); err != nil {
+				return nil, err
+			}
+			iter.started++
+		}
+		iter.fileIndex++
+		if err := iter.push(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+
+	// Poll the followed files after the others are read out
+	if iter.cursors.Len() == 0 && len(iter.follow) > 0 {
+		for _, src := range iter.follow {
+			if iter.following[src.Name] {
+				continue
+			}
+			c, err := iter.openTail(ctx, src)
+			if err != nil {
+				return nil, err
+			}
+			iter.idle = append(iter.idle, c)
+		}
+		idle := iter.idle
+		iter.idle = nil
+		for _, c := range idle {
+			if err := iter.push(ctx, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if iter.cursors.Len() == 0 {
+		if len(iter.idle) > 0 {
+			return nil, errNoNewLog
+		}
+		return nil, io.EOF
+	}
+	c := heap.Pop(&iter.cursors).(*logCursor)
+	entry := c.head
+	if err := iter.push(ctx, c); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// push reads the head item of the cursor and pushes the cursor into the heap
+// if the head item exists.
+func (iter *logIterator) push(ctx context.Context, c *logCursor) error {
+	switch err := c.advance(ctx); err {
+	case nil:
+		heap.Push(&iter.cursors, c)
+	case errNoNewLog:
+		iter.idle = append(iter.idle, c)
+	case io.EOF:
+		c.close()
+	default:
+		return err
+	}
+	return nil
+}
+
+// openCursor opens the pending file at index i to read.
+func (iter *logIterator) openCursor(ctx context.Context, i int) (*logCursor, error) {
+	f := iter.pending[i]
+	c := iter.newCursor(i, f.source, f.parser)
+	if err := c.open(ctx, f); err != nil {
+		return nil, err
+	}
+	// The active log file is followed after the existing lines are read
+	if src, ok := iter.followedSource(f); ok {
+		c.tail = newLogTail(src.Path, f.file, c.reader, c.throttledReader(ctx))
+		iter.setFollowing(src.Name)
+	}
+	return c, nil
+}
+
+// followedSource returns the source if the file is its active log file to
+// follow.
+func (iter *logIterator) followedSource(f logFile) (LogSource, bool) {
+	if f.compressed {
+		return LogSource{}, false
+	}
+	for _, src := range iter.follow {
+		if src.Name == f.source && !iter.following[src.Name] && isSameFile(f.file, src.Path) {
+			return src, true
+		}
+	}
+	return LogSource{}, false
+}
+
+// openTail opens the active log file of the source to follow if it's not one
+// of the pending files, e.g. it's empty or all its items are earlier than
+// begin.
+func (iter *logIterator) openTail(ctx context.Context, src LogSource) (*logCursor, error) {
+	iter.setFollowing(src.Name)
+	c := iter.newCursor(len(iter.pending), src.Name, src.Parser)
+	file, err := os.Open(src.Path)
+	if os.IsNotExist(err) {
+		c.tail = newLogTail(src.Path, nil, nil, c.throttledReader(ctx))
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.throttle.start()
+	defer c.throttle.stop()
+	offset, err := seekToTime(ctx, file, src.Parser, iter.begin, &c.throttle)
+	if err == nil {
+		if c.reader, err = readerFrom(file, offset, c.throttledReader(ctx)); err == nil {
+			c.tail = newLogTail(src.Path, file, c.reader, c.throttledReader(ctx))
+			return c, nil
+		}
+	}
+	_ = file.Close()
+	return nil, err
+}
+
+func (iter *logIterator) setFollowing(source string) {
+	if iter.following == nil {
+		iter.following = make(map[string]bool)
+	}
+	iter.following[source] = true
+}
+
+func (iter *logIterator) newCursor(rank int, source string, parser LogParser) *logCursor {
+	c := &logCursor{
+		iter:      iter,
+		rank:      rank,
+		source:    source,
+		parser:    parser,
+		multiline: iter.multiline || isMultiline(parser),
+		throttle:  cursorThrottle{limits: iter.throttle},
+	}
+	if preceding, _ := iter.contextItems(); preceding > 0 {
+		c.preceding = newContextRing(preceding)
+	}
+	return c
+}
+
+// throttledReader returns a function wrapping the readers of the cursor to
+// charge the reads to its throttle.
+func (c *logCursor) throttledReader(ctx context.Context) func(io.Reader) io.Reader {
+	return func(r io.Reader) io.Reader {
+		return c.throttle.reader(ctx, r)
+	}
+}
+
+// wait waits for the next poll of the followed log files.
+func (iter *logIterator) wait(ctx context.Context) error {
+	timer := time.NewTimer(iter.pollInterval())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (iter *logIterator) pollInterval() time.Duration {
+	if iter.followInterval <= 0 {
+		return DefaultFollowInterval
+	}
+	return iter.followInterval
+}
+
+// readerFrom returns a reader of the file starting from the first line after
+// offset, the partial line at offset is skipped. The file is read through
+// wrap.
+func readerFrom(file *os.File, offset int64, wrap func(io.Reader) io.Reader) (*bufio.Reader, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(wrap(file))
+	if offset > 0 {
+		if _, err := readLine(reader); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+func isSameFile(file *os.File, path string) bool {
+	lhs, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	rhs, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(lhs, rhs)
+}
+
+// logCursorHeap is a heap of cursors ordered by the time of their head items,
+// the earliest first, or the latest first in reverse mode.
+type logCursorHeap struct {
+	cursors []*logCursor
+	reverse bool
+}
+
+func (h *logCursorHeap) Len() int { return len(h.cursors) }
+
+func (h *logCursorHeap) Less(i, j int) bool {
+	lhs, rhs := h.cursors[i], h.cursors[j]
+	if lhs.head.Time != rhs.head.Time {
+		return (lhs.head.Time < rhs.head.Time) != h.reverse
+	}
+	// Keep the order of the files for the items at the same time
+	return (lhs.rank < rhs.rank) != h.reverse
+}
+
+func (h *logCursorHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *logCursorHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*logCursor)) }
+
+func (h *logCursorHeap) Pop() interface{} {
+	c := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return c
+}
+
+// logCursor reads the log items of a single file.
+type logCursor struct {
+	iter      *logIterator
+	rank      int       // the index of the file in the pending files
+	head      *LogEntry // the next matched item
+	source    string
+	parser    LogParser
+	multiline bool
+
+	// the matched items of the background scan
+	batches  chan logBatch
+	buffered []*LogEntry
+	err      error
+
+	// context items, see WithContext
+	preceding *contextRing
+	trailing  int         // the number of the items to return after a match
+	queued    []*LogEntry // the matched item and its preceding items
+
+	reader *bufio.Reader
+	// counter counts the bytes read by the reader from the offset base, nil
+	// if the offsets of the items aren't known, e.g. in reverse mode
+	counter *countingReader
+	base    int64
+	itemEnd int64 // the offset after the item read last
+	preLog  *pb.LogMessage
+	record  *pb.LogMessage // the multi-line item being read
+	tail    *logTail       // not nil if the file is followed
+	// idleSince is the time since when no new lines of the followed file
+	// are found, zero if the record is being appended
+	idleSince time.Time
+	// truncated is set if the lines of the record beyond maxRecordSize have
+	// been dropped
+	truncated bool
+	// throttle charges the bytes read and the time taken by the cursor
+	throttle cursorThrottle
+	// indexer builds the index of the compressed file read from the start
+	indexer *logIndexBuilder
+	file    *os.File
+
+	// reverse mode
+	backward      *reverseLineReader
+	continuations []string         // the continuation lines read backwards
+	ready         []*pb.LogMessage // the items to return in reverse mode
+}
+
+// open opens the file to read from the first item in the time range.
+func (c *logCursor) open(ctx context.Context, f logFile) error {
+	c.throttle.start()
+	defer c.throttle.stop()
+	if c.iter.reverse {
+		backward, err := newReverseLineReader(ctx, f, f.parser, c.iter.begin, c.iter.end, &c.throttle)
 		if err != nil {
 			return err
 		}
-		iter.reader = bufio.NewReader(gr)
+		c.backward = backward
+		return nil
+	}
+	if f.resume != nil {
+		c.trailing = f.resume.Trailing
+		c.preLog = &pb.LogMessage{Time: f.resume.Time, Level: f.resume.Level}
+	}
+	if !f.compressed {
+		var offset int64
+		if f.resume != nil {
+			offset = f.resume.Offset
+		} else if c.iter.begin > f.begin {
+			var err error
+			offset, err = seekToTime(ctx, f.file, f.parser, c.iter.begin, &c.throttle)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		c.counter = &countingReader{r: c.throttle.reader(ctx, f.file)}
+		c.base = offset
+		c.reader = bufio.NewReader(c.counter)
+		// skip the partial line at the offset found by time
+		if offset > 0 && f.resume == nil {
+			if _, err := readLine(c.reader); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		return nil
+	}
+	gr, err := gzip.NewReader(c.throttle.reader(ctx, f.file))
+	if err != nil {
+		return err
+	}
+	c.counter = &countingReader{r: gr}
+	// skip ahead to the checkpoint without parsing lines
+	offset := seekCheckpoint(f.checkpoints, c.iter.begin)
+	if f.resume != nil {
+		offset = f.resume.Offset
 	}
+	// build the index if the file is read from the start
+	if len(f.checkpoints) == 0 && offset == 0 {
+		c.indexer = &logIndexBuilder{}
+		c.file = f.file
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.counter, offset); err != nil {
+			return err
+		}
+	}
+	c.reader = bufio.NewReader(c.counter)
 	return nil
 }
 
-func (iter *logIterator) next(ctx context.Context) (*pb.LogMessage, error) {
-	// initial state
-	if iter.reader == nil {
-		if len(iter.pending) == 0 {
-			return nil, io.EOF
+// offset returns the offset of the next line to read, -1 if unknown.
+func (c *logCursor) offset() int64 {
+	if c.counter == nil || c.tail != nil {
+		return -1
+	}
+	return c.base + c.counter.n - int64(c.reader.Buffered())
+}
+
+// advance reads the next matched item as the head item.
+func (c *logCursor) advance(ctx context.Context) error {
+	c.head = nil
+	var item *LogEntry
+	var err error
+	if c.batches != nil {
+		item, err = c.nextPrefetched(ctx)
+	} else {
+		item, err = c.read(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	c.head = item
+	return nil
+}
+
+// readInRange reads the next item of the file in the time range. The items
+// of a single file are in time order, so io.EOF is returned once the item
+// beyond the time range is read.
+func (c *logCursor) readInRange(ctx context.Context) (*pb.LogMessage, error) {
+	for {
+		if err := c.throttle.pause(ctx); err != nil {
+			return nil, err
 		}
-		if err := iter.updateToNextReader(); err != nil {
+		var item *pb.LogMessage
+		var err error
+		if c.iter.reverse {
+			item, err = c.readItemReverse(ctx)
+		} else {
+			item, err = c.readItem(ctx)
+		}
+		if err != nil {
 			return nil, err
 		}
+		if c.iter.reverse {
+			if item.Time < c.iter.begin {
+				return nil, io.EOF
+			}
+			if item.Time > c.iter.end {
+				continue
+			}
+		} else {
+			if item.Time > c.iter.end {
+				return nil, io.EOF
+			}
+			if item.Time < c.iter.begin {
+				continue
+			}
+		}
+		return item, nil
+	}
+}
+
+func (c *logCursor) close() {
+	if c.tail != nil {
+		c.tail.close()
 	}
+}
 
-nextLine:
+// readItem reads the next log item of the file. If the file is followed,
+// errNoNewLog is returned after the lines written so far are read.
+func (c *logCursor) readItem(ctx context.Context) (*pb.LogMessage, error) {
 	for {
 		if isCtxDone(ctx) {
 			return nil, ctx.Err()
 		}
-		line, err := readLine(iter.reader)
-		// Switch to next log file
-		if err != nil && err == io.EOF {
-			iter.fileIndex++
-			if iter.fileIndex >= len(iter.pending) {
-				return nil, io.EOF
+		lineStart := c.offset()
+		var line string
+		var err error
+		if c.tail != nil {
+			line, err = c.tail.readLine()
+		} else {
+			line, err = readLine(c.reader)
+		}
+		if err == io.EOF {
+			// flush the last multi-line item. The continuation lines may
+			// still be appended to the followed file, so the item is kept
+			// until no new lines are found for a poll interval.
+			if c.tail != nil && c.record != nil {
+				if c.idleSince.IsZero() {
+					c.idleSince = time.Now()
+				}
+				if time.Since(c.idleSince) < c.iter.pollInterval() {
+					return nil, errNoNewLog
+				}
 			}
-			if err := iter.updateToNextReader(); err != nil {
-				return nil, err
+			c.idleSince = time.Time{}
+			if item := c.record; item != nil {
+				c.record = nil
+				c.itemEnd = c.offset()
+				return item, nil
 			}
-			continue
+			if c.tail != nil {
+				return nil, errNoNewLog
+			}
+			if c.indexer != nil {
+				// The index is only a cache
+				_, _ = c.indexer.store(c.file.Name(), c.file)
+				c.indexer = nil
+			}
+			return nil, io.EOF
 		}
+		if err != nil {
+			return nil, err
+		}
+		c.idleSince = time.Time{}
 		line = strings.TrimSpace(line)
-		if iter.preLog == nil && len(line) < timeStampLayoutLen {
-			continue
+		item, err := c.parser.ParseLogItem(line)
+		if err == nil && c.indexer != nil {
+			c.indexer.add(item.Time, lineStart)
+		}
+		if c.multiline {
+			// The item isn't complete until the beginning of next item is read.
+			if err != nil {
+				if c.record != nil {
+					c.truncated = appendLine(c.record, line, c.iter.maxRecordSize, c.truncated)
+				}
+				continue
+			}
+			item, c.record, c.truncated = c.record, item, false
+			if item == nil {
+				continue
+			}
+			c.itemEnd = lineStart
+			return item, nil
 		}
-		item, err := parseLogItem(line)
 		if err != nil {
-			if iter.preLog == nil {
+			if c.preLog == nil {
 				continue
 			}
 			// handle invalid log
 			// make whole line as log message with pre time and pre log_level
 			item = &pb.LogMessage{
-				Time:    iter.preLog.Time,
-				Level:   iter.preLog.Level,
+				Time:    c.preLog.Time,
+				Level:   c.preLog.Level,
 				Message: line,
 			}
 		} else {
-			iter.preLog = item
+			c.preLog = item
 		}
-		// It assumes no time range overlap for log files.
-		if item.Time > iter.end {
-			return nil, io.EOF
+		c.itemEnd = c.offset()
+		return item, nil
+	}
+}
+
+// readItemReverse reads the previous log item of the file. The continuation
+// lines are buffered until the beginning of their item is read.
+func (c *logCursor) readItemReverse(ctx context.Context) (*pb.LogMessage, error) {
+	for len(c.ready) == 0 {
+		if isCtxDone(ctx) {
+			return nil, ctx.Err()
+		}
+		line, err := c.backward.prevLine(ctx)
+		// drop the continuation lines without the beginning of item
+		if err != nil {
+			return nil, err
 		}
-		if item.Time < iter.begin {
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
-		// always keep unknown log_level
-		if item.Level > pb.LogLevel_UNKNOWN && iter.levelFlag != 0 && iter.levelFlag&(1<<item.Level) == 0 {
+		item, err := c.parser.ParseLogItem(line)
+		if err != nil {
+			c.continuations = append(c.continuations, line)
 			continue
 		}
-		if len(iter.patterns) > 0 {
-			for _, p := range iter.patterns {
-				if !p.MatchString(item.Message) {
-					continue nextLine
-				}
+		if c.multiline {
+			truncated := false
+			for i := len(c.continuations) - 1; i >= 0; i-- {
+				truncated = appendLine(item, c.continuations[i], c.iter.maxRecordSize, truncated)
+			}
+		} else {
+			// make continuation lines as log messages with the time and
+			// log_level of the item, the newest first
+			for _, line := range c.continuations {
+				c.ready = append(c.ready, &pb.LogMessage{
+					Time:    item.Time,
+					Level:   item.Level,
+					Message: line,
+				})
 			}
 		}
-		return item, nil
+		c.ready = append(c.ready, item)
+		c.continuations = c.continuations[:0]
+	}
+	item := c.ready[0]
+	c.ready = c.ready[1:]
+	return item, nil
+}
+
+// reverseLineReader reads the lines of a log file backwards.
+type reverseLineReader struct {
+	file     *os.File
+	cursor   int64    // the end of the unread content of uncompressed file
+	lines    []string // the lines read but not returned yet, in file order
+	throttle *cursorThrottle
+
+	// The decompressed ranges of compressed file to read, in file order
+	compressed   bool
+	ranges       []offsetRange
+	decompressed int64 // the decompressed bytes so far
+}
+
+// reverseWindowSize is the decompressed bytes of compressed file read at a
+// time backwards. The file is decompressed from the start for each window,
+// so the windows are much larger than the ranges between checkpoints.
+var reverseWindowSize int64 = 32 * 1024 * 1024
+
+// offsetRange is a range of the decompressed content of compressed file, end
+// is -1 if the range ends at the end of file.
+type offsetRange struct {
+	start, end int64
+}
+
+// newReverseLineReader creates a reverseLineReader for the log file. The
+// lines of uncompressed file are read by readLastLines. Since gzip cannot be
+// read backwards, the checkpoints in the time range are grouped into windows
+// of about reverseWindowSize, and the compressed file is decompressed from
+// the start for each window, newest first, so that at most a window is held
+// in memory. The index is built first if the file has none.
+func newReverseLineReader(ctx context.Context, f logFile, parser LogParser, begin, end int64, throttle *cursorThrottle) (*reverseLineReader, error) {
+	if !f.compressed {
+		stat, err := f.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return &reverseLineReader{file: f.file, cursor: stat.Size(), throttle: throttle}, nil
+	}
+
+	checkpoints := f.checkpoints
+	if len(checkpoints) == 0 {
+		index, err := buildLogIndex(ctx, f.file, parser, throttle)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = index.Checkpoints
+	}
+	r := &reverseLineReader{file: f.file, throttle: throttle, compressed: true}
+	from := seekCheckpoint(checkpoints, begin)
+	for i, c := range checkpoints {
+		if c.Offset < from {
+			continue
+		}
+		// The items from the checkpoint on are later than end
+		if c.Time > end {
+			break
+		}
+		rng := offsetRange{start: c.Offset, end: -1}
+		// keep the continuation lines before the first item
+		if i == 0 {
+			rng.start = 0
+		}
+		if i+1 < len(checkpoints) {
+			rng.end = checkpoints[i+1].Offset
+		}
+		if n := len(r.ranges); n > 0 && rng.start-r.ranges[n-1].start < reverseWindowSize {
+			r.ranges[n-1].end = rng.end
+			continue
+		}
+		r.ranges = append(r.ranges, rng)
+	}
+	return r, nil
+}
+
+// readRange decompresses the lines of the range of the compressed file.
+func (r *reverseLineReader) readRange(ctx context.Context, rng offsetRange) ([]string, error) {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(r.throttle.reader(ctx, r.file))
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: gr}
+	defer func() {
+		r.decompressed += counter.n
+	}()
+	if _, err := io.CopyN(ioutil.Discard, counter, rng.start); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(counter)
+	var lines []string
+	for rng.end < 0 || counter.n-int64(reader.Buffered()) < rng.end {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+		if isCtxDone(ctx) {
+			return nil, ctx.Err()
+		}
+		if err := r.throttle.pause(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+func (r *reverseLineReader) prevLine(ctx context.Context) (string, error) {
+	for len(r.lines) == 0 {
+		if r.compressed {
+			n := len(r.ranges)
+			if n == 0 {
+				return "", io.EOF
+			}
+			lines, err := r.readRange(ctx, r.ranges[n-1])
+			if err != nil {
+				return "", err
+			}
+			r.ranges, r.lines = r.ranges[:n-1], lines
+			continue
+		}
+		if r.cursor <= 0 {
+			return "", io.EOF
+		}
+		lines, readBytes, err := readLastLines(ctx, r.file, r.cursor)
+		if err != nil {
+			return "", err
+		}
+		if readBytes == 0 {
+			return "", io.EOF
+		}
+		if err := r.throttle.read(ctx, readBytes); err != nil {
+			return "", err
+		}
+		r.cursor -= int64(readBytes)
+		r.lines = lines
+	}
+	line := r.lines[len(r.lines)-1]
+	r.lines = r.lines[:len(r.lines)-1]
+	return line, nil
+}
+
+// defaultMaxRecordSize is the default maximum bytes of a multi-line item.
+const defaultMaxRecordSize = 1024 * 1024
+
+// appendLine appends a continuation line to the message of a multi-line item.
+// Once the message would exceed maxSize bytes, LogMessageTruncatedMarker is
+// appended as the last line and the following lines are dropped. It returns
+// whether the item has been truncated.
+func appendLine(item *pb.LogMessage, line string, maxSize int, truncated bool) bool {
+	if truncated {
+		return true
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxRecordSize
+	}
+	if len(item.Message)+1+len(line) > maxSize {
+		line, truncated = LogMessageTruncatedMarker, true
+	}
+	if item.Message == "" {
+		item.Message = line
+	} else {
+		item.Message += "\n" + line
+	}
+	return truncated
+}
+
+// logPattern is a pattern of the log messages, which is matched by substring
+// search if it's a literal string.
+type logPattern struct {
+	re      *regexp.Regexp // nil for literal
+	literal string
+	fold    bool // the literal is matched case-insensitively
+	negate  bool
+}
+
+func (p *logPattern) match(message string) bool {
+	var matched bool
+	switch {
+	case p.re != nil:
+		matched = p.re.MatchString(message)
+	case p.fold:
+		matched = containsFold(message, p.literal)
+	default:
+		matched = strings.Contains(message, p.literal)
+	}
+	return matched != p.negate
+}
+
+func matchAny(message string, patterns []logPattern) bool {
+	for i := range patterns {
+		if patterns[i].match(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// isASCIIFoldable checks whether the case-insensitive matches of s are all
+// ASCII, which isn't true for k (the Kelvin sign) and s (the long s).
+func isASCIIFoldable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= utf8.RuneSelf, c == 'k', c == 'K', c == 's', c == 'S':
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether substr, which is isASCIIFoldable, is within s
+// case-insensitively.
+func containsFold(s, substr string) bool {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLine returns the first line of the message, which skips the
+// continuation lines of multi-line items.
+func firstLine(message string) string {
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		return message[:i]
+	}
+	return message
+}
+
+// matchFields checks whether the structured log content has all filter
+// fields with the exact values.
+func matchFields(message string, filters []LogField) bool {
+	l, err := ParseStructuredLog(firstLine(message))
+	if err != nil {
+		return false
+	}
+	for _, f := range filters {
+		if v, ok := l.Field(f.Key); !ok || v != f.Value {
+			return false
+		}
 	}
+	return true
 }
@@ -15,15 +15,18 @@
 package sysutil_test
 
 import (
+	"bufio"
 	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -32,26 +35,43 @@ import (
 	"github.com/pingcap/sysutil"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type searchLogSuite struct {
 	server  *grpc.Server
 	address string
 	tmpDir  string
+
+	// searchOpts are passed to each SearchLog call of the server
+	searchOpts []sysutil.SearchLogOption
+}
+
+type searchLogServer struct {
+	*sysutil.DiagnosticsServer
+	suite *searchLogSuite
+}
+
+func (s *searchLogServer) SearchLog(req *pb.SearchLogRequest, stream pb.Diagnostics_SearchLogServer) error {
+	return s.SearchLogWithOptions(req, stream, s.suite.searchOpts...)
 }
 
-func createSearchLogSuite(t testing.TB) (*searchLogSuite, func()) {
+func createSearchLogSuite(t testing.TB, opts ...sysutil.DiagnosticsServerOption) (*searchLogSuite, func()) {
 	tmpDir, err := ioutil.TempDir("", "sysutil")
 	require.NoError(t, err)
 
+	s := new(searchLogSuite)
 	server := grpc.NewServer()
-	pb.RegisterDiagnosticsServer(server, sysutil.NewDiagnosticsServer(filepath.Join(tmpDir, "rpc.tidb.log")))
+	opts = append([]sysutil.DiagnosticsServerOption{sysutil.WithSlowLogFile(filepath.Join(tmpDir, "rpc.tidb-slow.log"))}, opts...)
+	pb.RegisterDiagnosticsServer(server, &searchLogServer{
+		DiagnosticsServer: sysutil.NewDiagnosticsServer(filepath.Join(tmpDir, "rpc.tidb.log"), opts...),
+		suite:             s,
+	})
 
 	// Find a available port
 	listener, err := net.Listen("tcp", ":0")
 	require.NoError(t, err, "cannot find available port")
 
-	s := new(searchLogSuite)
 	s.tmpDir = tmpDir
 	s.server = server
 	s.address = fmt.Sprintf(":%d", listener.Addr().(*net.TCPAddr).Port)
@@ -76,6 +96,19 @@ func (s *searchLogSuite) writeTmpFile(t testing.TB, filename string, lines []str
 	require.NoError(t, err, fmt.Sprintf("write tmp file %s failed", filename))
 }
 
+func (s *searchLogSuite) readTmpFileLine(t testing.TB, filename string, n int) string {
+	content, err := ioutil.ReadFile(filepath.Join(s.tmpDir, filename))
+	require.NoError(t, err)
+	return strings.Split(string(content), "\n")[n]
+}
+
+// itemTime returns the time of the log item at line n of the file.
+func (s *searchLogSuite) itemTime(t testing.TB, filename string, n int) int64 {
+	item, err := sysutil.ParseLogItem(s.readTmpFileLine(t, filename, n))
+	require.NoError(t, err)
+	return item.Time
+}
+
 func (s *searchLogSuite) writeTmpGzipFile(t testing.TB, filename string, lines []string) {
 	gzf, err := os.OpenFile(filepath.Join(s.tmpDir, filename), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
 	require.NoError(t, err, fmt.Sprintf("write tmp gzip file %s failed", filename))
@@ -85,6 +118,38 @@ func (s *searchLogSuite) writeTmpGzipFile(t testing.TB, filename string, lines [
 	require.NoError(t, err, fmt.Sprintf("write tmp gzip file %s failed", filename))
 }
 
+// searchLog sends the request to the suite server and collects all messages.
+func (s *searchLogSuite) searchLog(t testing.TB, req *pb.SearchLogRequest) []*pb.LogMessage {
+	messages, _ := s.searchLogWithTrailer(t, req)
+	return messages
+}
+
+// searchLogWithTrailer is the same as searchLog, but also returns the trailer metadata.
+func (s *searchLogSuite) searchLogWithTrailer(t testing.TB, req *pb.SearchLogRequest) ([]*pb.LogMessage, metadata.MD) {
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := pb.NewDiagnosticsClient(conn).SearchLog(ctx, req)
+	require.NoError(t, err)
+
+	var messages []*pb.LogMessage
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		messages = append(messages, res.Messages...)
+	}
+	return messages, stream.Trailer()
+}
+
 func TestResolveFiles(t *testing.T) {
 	s, clean := createSearchLogSuite(t)
 	defer clean()
@@ -209,7 +274,7 @@ func TestResolveFiles(t *testing.T) {
 		require.NoError(t, err)
 		endTime, err := sysutil.ParseTimeStamp(cas.search.end)
 		require.NoError(t, err)
-		logFiles, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "tidb.log"), beginTime, endTime)
+		logFiles, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "tidb.log"), sysutil.UnifiedLogParser{}, beginTime, endTime)
 		require.NoError(t, err)
 		require.Len(t, logFiles, len(cas.expect), fmt.Sprintf("search range (index: %d): %+v", i, cas.search))
 
@@ -224,6 +289,60 @@ func TestResolveFiles(t *testing.T) {
 	}
 }
 
+func TestResolveFilesByRotationTime(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	// lumberjack names the backup files by the local time
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2019, 8, 26, hour, min, sec, 0, time.Local)
+	}
+	logLine := func(tt time.Time) string {
+		return fmt.Sprintf(`[%s] [INFO] [printer.go:41] ["Welcome to TiDB."]`, tt.Format(sysutil.TimeStampLayout))
+	}
+
+	s.writeTmpGzipFile(t, "rpc.tidb-2019-08-26T06-20-00.000.log.gz", []string{
+		logLine(at(6, 10, 0)),
+		logLine(at(6, 19, 59)),
+	})
+	// the tail of the uncompressed backup file is too long to find the last item
+	lines := []string{logLine(at(6, 20, 0))}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, "goroutine 1 [running]:")
+	}
+	s.writeTmpFile(t, "rpc.tidb-2019-08-26T06-30-00.000.log", lines)
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		logLine(at(6, 30, 0)),
+		logLine(at(6, 40, 0)),
+	})
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	indexPath := filepath.Join(s.tmpDir, "rpc.tidb-2019-08-26T06-20-00.000.log.gz.idx")
+
+	// the compressed file is pruned by its rotation time without building index
+	logFiles, err := sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(at(6, 25, 0)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 2)
+	require.Equal(t, toMillis(at(6, 20, 0)), logFiles[0].BeginTime())
+	require.Equal(t, toMillis(at(6, 30, 0)), logFiles[0].EndTime())
+	_, err = os.Stat(indexPath)
+	require.True(t, os.IsNotExist(err))
+
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(at(6, 15, 0)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 3)
+	require.Equal(t, toMillis(at(6, 20, 0)), logFiles[0].EndTime())
+
+	// the index is built once the compressed file is read out
+	require.Len(t, s.searchLog(t, &pb.SearchLogRequest{StartTime: toMillis(at(6, 15, 0))}), 24)
+	_, err = os.Stat(indexPath)
+	require.NoError(t, err)
+	logFiles, err = sysutil.ResolveFiles(context.Background(), path, sysutil.UnifiedLogParser{}, toMillis(at(6, 15, 0)), math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, logFiles, 3)
+	require.Equal(t, toMillis(at(6, 19, 59)), logFiles[0].EndTime())
+}
+
 func TestLogIterator(t *testing.T) {
 	s, clean := createSearchLogSuite(t)
 	defer clean()
@@ -516,6 +635,1000 @@ func TestLogIterator(t *testing.T) {
 	}
 }
 
+func TestMultilineAggregation(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`goroutine 0 [running]:`,
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [ERROR] [misc.go:91] ["panic in the recoverable goroutine"] [conn=1]`,
+		`goroutine 1 [running]:`,
+		`github.com/pingcap/tidb/util.Recover()`,
+		`[2019/08/26 06:19:15.011 -04:00] [INFO] [session.go:41] ["execute sql"] [sql="select *"]`,
+		`from t`,
+		`where a = 1`,
+	})
+
+	cases := []struct {
+		patterns []string
+		opts     []sysutil.SearchLogOption
+		expect   []string
+	}{
+		{
+			patterns: []string{"goroutine"},
+			expect: []string{
+				"[misc.go:91] [\"panic in the recoverable goroutine\"] [conn=1]",
+				"goroutine 1 [running]:",
+			},
+		},
+		{
+			patterns: []string{"goroutine"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(0)},
+			expect: []string{
+				"[misc.go:91] [\"panic in the recoverable goroutine\"] [conn=1]\ngoroutine 1 [running]:\ngithub.com/pingcap/tidb/util.Recover()",
+			},
+		},
+		{
+			patterns: []string{"Recover"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(0), sysutil.WithFieldFilter("conn", "1")},
+			expect: []string{
+				"[misc.go:91] [\"panic in the recoverable goroutine\"] [conn=1]\ngoroutine 1 [running]:\ngithub.com/pingcap/tidb/util.Recover()",
+			},
+		},
+		{
+			patterns: []string{"where a = 1"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(0)},
+			expect: []string{
+				"[session.go:41] [\"execute sql\"] [sql=\"select *\"]\nfrom t\nwhere a = 1",
+			},
+		},
+		{
+			// the lines beyond the size are dropped with a marker
+			patterns: []string{"execute sql"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(64)},
+			expect: []string{
+				"[session.go:41] [\"execute sql\"] [sql=\"select *\"]\nfrom t\n" + sysutil.LogMessageTruncatedMarker,
+			},
+		},
+		{
+			patterns: []string{"execute sql"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(64), sysutil.WithReverse()},
+			expect: []string{
+				"[session.go:41] [\"execute sql\"] [sql=\"select *\"]\nfrom t\n" + sysutil.LogMessageTruncatedMarker,
+			},
+		},
+		{
+			// the item fits in the size exactly
+			patterns: []string{"execute sql"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(67)},
+			expect: []string{
+				"[session.go:41] [\"execute sql\"] [sql=\"select *\"]\nfrom t\nwhere a = 1",
+			},
+		},
+	}
+	for i, cas := range cases {
+		s.searchOpts = cas.opts
+		var got []string
+		for _, m := range s.searchLog(t, &pb.SearchLogRequest{Patterns: cas.patterns}) {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, cas.expect, got, "case %d", i)
+	}
+}
+
+func TestSearchLogLimit(t *testing.T) {
+	s, clean := createSearchLogSuite(t, sysutil.WithSearchLogLimit(3000))
+	defer clean()
+
+	s.writeSecondlyLogFile(t, "rpc.tidb.log", 5000)
+
+	cases := []struct {
+		opts      []sysutil.SearchLogOption
+		expect    int
+		truncated bool
+	}{
+		{expect: 3000, truncated: true},
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(10)}, expect: 10, truncated: true},
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(-1)}, expect: 5050},
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(6000)}, expect: 5050},
+		// no more items match after the limit
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(5050)}, expect: 5050},
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(5049)}, expect: 5049, truncated: true},
+		{opts: []sysutil.SearchLogOption{sysutil.WithLimit(5050), sysutil.WithReverse()}, expect: 5050},
+	}
+	for i, cas := range cases {
+		s.searchOpts = cas.opts
+		messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{})
+		require.Len(t, messages, cas.expect, "case %d", i)
+		if cas.truncated {
+			require.Equal(t, []string{"true"}, trailer.Get(sysutil.SearchLogTruncatedKey), "case %d", i)
+		} else {
+			require.Empty(t, trailer.Get(sysutil.SearchLogTruncatedKey), "case %d", i)
+		}
+	}
+}
+
+func TestReverseSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpGzipFile(t, "rpc.tidb-2.log.gz", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [ERROR] [misc.go:91] ["panic"]`,
+		`goroutine 1 [running]:`,
+		`[2019/08/26 06:19:15.011 -04:00] [WARN] [printer.go:41] ["Welcome to TiDB."]`,
+	})
+	s.writeTmpFile(t, "rpc.tidb-1.log", []string{
+		`goroutine 2 [running]:`,
+		`[2019/08/26 06:20:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:20:14.011 -04:00] [ERROR] [misc.go:91] ["panic"]`,
+		`goroutine 3 [running]:`,
+		`github.com/pingcap/tidb/util.Recover()`,
+	})
+	// large enough to be read backwards by several rounds
+	lines := []string{
+		`[2019/08/26 06:21:13.011 -04:00] [ERROR] [misc.go:91] ["panic"]`,
+		`goroutine 1 [running]:`,
+	}
+	start := time.Date(2019, 8, 26, 6, 21, 14, 0, time.FixedZone("", -4*3600))
+	for i := 0; i < 3000; i++ {
+		ts := start.Add(time.Duration(i) * time.Second).Format(sysutil.TimeStampLayout)
+		lines = append(lines, fmt.Sprintf(`[%s] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, ts, i))
+	}
+	s.writeTmpFile(t, "rpc.tidb.log", lines)
+
+	reversed := func(messages []*pb.LogMessage) []*pb.LogMessage {
+		res := make([]*pb.LogMessage, 0, len(messages))
+		for i := len(messages) - 1; i >= 0; i-- {
+			res = append(res, messages[i])
+		}
+		return res
+	}
+
+	cases := []struct {
+		start, end string
+		levels     []pb.LogLevel
+		patterns   []string
+		opts       []sysutil.SearchLogOption
+	}{
+		{start: "2019/08/26 06:00:00.000 -04:00", end: "2019/08/28 06:00:00.000 -04:00"},
+		{start: "2019/08/26 06:19:14.011 -04:00", end: "2019/08/26 06:20:14.011 -04:00"},
+		{start: "2019/08/26 06:19:14.011 -04:00", end: "2019/08/26 06:30:00.000 -04:00", levels: []pb.LogLevel{pb.LogLevel_Error}},
+		{start: "2019/08/26 06:00:00.000 -04:00", end: "2019/08/28 06:00:00.000 -04:00", patterns: []string{"goroutine|panic"}},
+		{
+			start:    "2019/08/26 06:00:00.000 -04:00",
+			end:      "2019/08/28 06:00:00.000 -04:00",
+			patterns: []string{"goroutine"},
+			opts:     []sysutil.SearchLogOption{sysutil.WithMultilineAggregation(0)},
+		},
+	}
+	for i, cas := range cases {
+		beginTime, err := sysutil.ParseTimeStamp(cas.start)
+		require.NoError(t, err)
+		endTime, err := sysutil.ParseTimeStamp(cas.end)
+		require.NoError(t, err)
+		req := &pb.SearchLogRequest{
+			StartTime: beginTime,
+			EndTime:   endTime,
+			Levels:    cas.levels,
+			Patterns:  cas.patterns,
+		}
+		s.searchOpts = append(cas.opts, sysutil.WithLimit(-1))
+		forward := s.searchLog(t, req)
+		require.NotEmpty(t, forward, "case %d", i)
+		s.searchOpts = append(cas.opts, sysutil.WithLimit(-1), sysutil.WithReverse())
+		require.Equal(t, reversed(forward), s.searchLog(t, req), "case %d", i)
+	}
+
+	// the last 3 errors
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithReverse(), sysutil.WithLimit(3), sysutil.WithMultilineAggregation(0)}
+	var got []string
+	for _, m := range s.searchLog(t, &pb.SearchLogRequest{Levels: []pb.LogLevel{pb.LogLevel_Error}}) {
+		got = append(got, m.Message)
+	}
+	require.Equal(t, []string{
+		`[misc.go:91] ["panic"]` + "\ngoroutine 1 [running]:",
+		`[misc.go:91] ["panic"]` + "\ngoroutine 3 [running]:\ngithub.com/pingcap/tidb/util.Recover()",
+		`[misc.go:91] ["panic"]` + "\ngoroutine 1 [running]:",
+	}, got)
+}
+
+func TestMergeOverlappingLogs(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	logLine := func(sec int, level, msg string) string {
+		return fmt.Sprintf(`[2019/08/26 06:19:%02d.011 -04:00] [%s] [printer.go:41] ["%s"]`, sec, level, msg)
+	}
+	// written by two processes
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		logLine(10, "INFO", "a1"),
+		logLine(12, "ERROR", "a2"),
+		`goroutine 1 [running]:`,
+		logLine(14, "INFO", "a3"),
+		logLine(16, "INFO", "a4"),
+	})
+	s.writeTmpFile(t, "rpc.tidb-1.log", []string{
+		logLine(11, "INFO", "b1"),
+		logLine(12, "INFO", "b2"),
+		logLine(13, "WARN", "b3"),
+		logLine(20, "INFO", "b4"),
+	})
+	// restored from backup
+	s.writeTmpGzipFile(t, "rpc.tidb-2.log.gz", []string{
+		logLine(9, "INFO", "c1"),
+		logLine(15, "INFO", "c2"),
+	})
+
+	search := func(start, end int, opts ...sysutil.SearchLogOption) []string {
+		beginTime, err := sysutil.ParseTimeStamp(fmt.Sprintf("2019/08/26 06:19:%02d.011 -04:00", start))
+		require.NoError(t, err)
+		endTime, err := sysutil.ParseTimeStamp(fmt.Sprintf("2019/08/26 06:19:%02d.011 -04:00", end))
+		require.NoError(t, err)
+		s.searchOpts = opts
+		var messages []string
+		for _, m := range s.searchLog(t, &pb.SearchLogRequest{StartTime: beginTime, EndTime: endTime}) {
+			messages = append(messages, m.Message)
+		}
+		return messages
+	}
+	msg := func(msgs ...string) []string {
+		var res []string
+		for _, m := range msgs {
+			if m == "goroutine" {
+				res = append(res, `goroutine 1 [running]:`)
+			} else {
+				res = append(res, fmt.Sprintf(`[printer.go:41] ["%s"]`, m))
+			}
+		}
+		return res
+	}
+
+	// the items at the same time are ordered by the start time of files
+	require.Equal(t, msg("c1", "a1", "b1", "a2", "goroutine", "b2", "b3", "a3", "c2", "a4", "b4"), search(0, 59))
+	require.Equal(t, msg("a2", "goroutine", "b2", "b3", "a3", "c2"), search(12, 15))
+	require.Equal(t, msg("c2", "a3", "b3", "b2", "goroutine", "a2"), search(10, 15, sysutil.WithReverse(), sysutil.WithLimit(6)))
+	require.Equal(t, []string{`[printer.go:41] ["a2"]` + "\ngoroutine 1 [running]:", `[printer.go:41] ["b2"]`, `[printer.go:41] ["b3"]`},
+		search(12, 13, sysutil.WithMultilineAggregation(0)))
+}
+
+func TestSearchLogSources(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sysutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	s, clean := createSearchLogSuite(t,
+		sysutil.WithLogSource("stderr", filepath.Join(tmpDir, "stderr.log"), nil),
+		sysutil.WithLogSource("audit", filepath.Join(tmpDir, "audit.log"), sysutil.JSONLogParser{}))
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:16.011 -04:00] [ERROR] [misc.go:91] ["panic"]`,
+	})
+	s.writeTmpFile(t, "rpc.tidb-slow.log", []string{
+		`# Time: 2019-08-26T06:19:15.011-04:00`,
+		`# Query_time: 1.5`,
+		`select * from t;`,
+	})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "stderr.log"), []byte(strings.Join([]string{
+		`[2019/08/26 06:19:14.011 -04:00] [WARN] [grpclog.go:45] ["transport is closing"]`,
+		`[2019/08/26 06:19:17.011 -04:00] [WARN] [grpclog.go:45] ["transport is closing"]`,
+	}, "\n")), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "audit.log"), []byte(
+		`{"time":"2019/08/26 06:19:18.011 -04:00","level":"INFO","message":"login","user":"root"}`), os.ModePerm))
+
+	var names []string
+	for _, src := range sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"),
+		sysutil.WithLogSource("stderr", filepath.Join(tmpDir, "stderr.log"), nil)).LogSources() {
+		names = append(names, src.Name)
+	}
+	require.Equal(t, []string{sysutil.MainLogSource, "stderr"}, names)
+
+	cases := []struct {
+		opts    []sysutil.SearchLogOption
+		expect  []string
+		sources []string
+	}{
+		{
+			expect: []string{`[printer.go:41] ["Welcome to TiDB."]`, `[misc.go:91] ["panic"]`},
+		},
+		{
+			opts: []sysutil.SearchLogOption{sysutil.WithSources("stderr", sysutil.MainLogSource)},
+			expect: []string{
+				`[printer.go:41] ["Welcome to TiDB."]`,
+				`[grpclog.go:45] ["transport is closing"]`,
+				`[misc.go:91] ["panic"]`,
+				`[grpclog.go:45] ["transport is closing"]`,
+			},
+			sources: []string{"main:1", "stderr:1", "main:1", "stderr:1"},
+		},
+		{
+			opts: []sysutil.SearchLogOption{sysutil.WithAllSources(), sysutil.WithReverse()},
+			expect: []string{
+				`[login] [user=root]`,
+				`[grpclog.go:45] ["transport is closing"]`,
+				`[misc.go:91] ["panic"]`,
+				"# Query_time: 1.5\nselect * from t;",
+				`[grpclog.go:45] ["transport is closing"]`,
+				`[printer.go:41] ["Welcome to TiDB."]`,
+			},
+			sources: []string{"audit:1", "stderr:1", "main:1", "slow:1", "stderr:1", "main:1"},
+		},
+	}
+	for i, cas := range cases {
+		s.searchOpts = cas.opts
+		messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{})
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, cas.expect, got, "case %d", i)
+		require.Equal(t, cas.sources, trailer.Get(sysutil.SearchLogSourcesKey), "case %d", i)
+	}
+
+	// the sources of the items by the Go API
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"),
+		sysutil.WithLogSource("stderr", filepath.Join(tmpDir, "stderr.log"), nil))
+	search, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{Levels: []pb.LogLevel{pb.LogLevel_Warn, pb.LogLevel_Error}},
+		sysutil.WithAllSources())
+	require.NoError(t, err)
+	defer search.Close()
+	var sources []string
+	for {
+		entry, err := search.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		sources = append(sources, entry.Source)
+	}
+	require.Equal(t, []string{"stderr", sysutil.MainLogSource, "stderr"}, sources)
+
+	_, err = d.NewLogSearch(context.Background(), &pb.SearchLogRequest{}, sysutil.WithSources("audit"))
+	require.Error(t, err)
+}
+
+func TestParallelSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	for i := 0; i < 8; i++ {
+		s.writeTmpGzipFile(t, fmt.Sprintf("rpc.tidb-%d.log.gz", i), leveledLogLines(i*1000, 1000))
+	}
+	// overlapping with the compressed files
+	s.writeTmpFile(t, "rpc.tidb-copy.log", leveledLogLines(2500, 1000))
+	s.writeTmpFile(t, "rpc.tidb.log", leveledLogLines(8000, 1000))
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	search := func(parallelism int, req *pb.SearchLogRequest, opts ...sysutil.SearchLogOption) []string {
+		d := sysutil.NewDiagnosticsServer(path, sysutil.WithSearchLogParallelism(parallelism))
+		search, err := d.NewLogSearch(context.Background(), req, opts...)
+		require.NoError(t, err)
+		defer search.Close()
+		var messages []string
+		for {
+			entry, err := search.Next()
+			if err == io.EOF {
+				return messages
+			}
+			require.NoError(t, err)
+			messages = append(messages, entry.Message)
+		}
+	}
+
+	cases := []struct {
+		req  *pb.SearchLogRequest
+		opts []sysutil.SearchLogOption
+	}{
+		{req: &pb.SearchLogRequest{}, opts: []sysutil.SearchLogOption{sysutil.WithLimit(-1)}},
+		{req: &pb.SearchLogRequest{StartTime: toMillis(atSecond(1500)), EndTime: toMillis(atSecond(6500))}},
+		{req: &pb.SearchLogRequest{Levels: []pb.LogLevel{pb.LogLevel_Error}, Patterns: []string{`line=\d*5\]`}}},
+		{req: &pb.SearchLogRequest{StartTime: toMillis(atSecond(1500))}, opts: []sysutil.SearchLogOption{sysutil.WithReverse()}},
+		{req: &pb.SearchLogRequest{}, opts: []sysutil.SearchLogOption{sysutil.WithLimit(10)}},
+		{req: &pb.SearchLogRequest{Patterns: []string{`line=\d*5\]`}}, opts: []sysutil.SearchLogOption{sysutil.WithContext(2, 1)}},
+	}
+	for i, cas := range cases {
+		expect := search(1, cas.req, cas.opts...)
+		require.NotEmpty(t, expect, "case %d", i)
+		require.Equal(t, expect, search(3, cas.req, cas.opts...), "case %d", i)
+	}
+}
+
+func TestCancelParallelSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 10000; i++ {
+		message := "Welcome to TiDB."
+		if i%100 == 0 {
+			message = "slow"
+		}
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] [%q] [line=%d]`, message, i))
+	}
+	s.writeTmpGzipFile(t, "rpc.tidb-1.log.gz", lines)
+	s.writeTmpFile(t, "rpc.tidb.log", nil)
+
+	// The iterator catches up with the slow scan, so the batches are drained
+	// when the search is canceled
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"),
+		sysutil.WithSearchLogParallelism(4),
+		sysutil.WithLogParser(slowLogParser{delay: 10 * time.Millisecond}))
+	for i := 0; i < 8; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		search, err := d.NewLogSearch(ctx, &pb.SearchLogRequest{}, sysutil.WithLimit(-1))
+		require.NoError(t, err)
+		for j := 0; j < 300; j++ {
+			_, err := search.Next()
+			require.NoError(t, err)
+		}
+		cancel()
+		// let the scan quit
+		time.Sleep(20 * time.Millisecond)
+		// the search never ends as if the file is read out
+		for err == nil {
+			_, err = search.Next()
+		}
+		require.Equal(t, context.Canceled, err, "run %d", i)
+		search.Close()
+	}
+}
+
+func TestPanicParallelSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	for i := 0; i < 3; i++ {
+		s.writeTmpGzipFile(t, fmt.Sprintf("rpc.tidb-%d.log.gz", i), []string{
+			fmt.Sprintf(`[2019/08/26 06:19:1%d.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`, i),
+			fmt.Sprintf(`[2019/08/26 06:19:1%d.012 -04:00] [INFO] [printer.go:41] ["bug"]`, i),
+		})
+	}
+	s.writeTmpFile(t, "rpc.tidb.log", nil)
+
+	parser := sysutil.LogParserFunc(func(line string) (*pb.LogMessage, error) {
+		if strings.Contains(line, "bug") {
+			panic("parser bug")
+		}
+		return sysutil.UnifiedLogParser{}.ParseLogItem(line)
+	})
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"),
+		sysutil.WithSearchLogParallelism(4),
+		sysutil.WithLogParser(parser))
+	search, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{})
+	require.NoError(t, err)
+	defer search.Close()
+	for err == nil {
+		_, err = search.Next()
+	}
+	require.Contains(t, err.Error(), "parser bug")
+}
+
+func TestSearchLogContext(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 12; i++ {
+		level := "INFO"
+		if i == 2 || i == 4 || i == 10 {
+			level = "ERROR"
+		}
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:%02d.011 -04:00] [%s] [printer.go:41] ["line %d"]`, 10+i, level, i))
+	}
+	s.writeTmpFile(t, "rpc.tidb.log", lines)
+
+	cases := []struct {
+		opts    []sysutil.SearchLogOption
+		expect  []int
+		context []string
+	}{
+		// the windows of the items 2 and 4 are merged
+		{
+			opts:    []sysutil.SearchLogOption{sysutil.WithContext(1, 2)},
+			expect:  []int{1, 2, 3, 4, 5, 6, 9, 10, 11},
+			context: []string{"context:1", "match:1", "context:1", "match:1", "context:3", "match:1", "context:1"},
+		},
+		{
+			opts:    []sysutil.SearchLogOption{sysutil.WithContext(3, 0)},
+			expect:  []int{0, 1, 2, 3, 4, 7, 8, 9, 10},
+			context: []string{"context:2", "match:1", "context:1", "match:1", "context:3", "match:1"},
+		},
+		{
+			opts:    []sysutil.SearchLogOption{sysutil.WithContext(1, 2), sysutil.WithReverse()},
+			expect:  []int{11, 10, 9, 6, 5, 4, 3, 2, 1},
+			context: []string{"context:1", "match:1", "context:3", "match:1", "context:1", "match:1", "context:1"},
+		},
+		{
+			opts:    []sysutil.SearchLogOption{sysutil.WithContext(1, 2), sysutil.WithLimit(4)},
+			expect:  []int{1, 2, 3, 4},
+			context: []string{"context:1", "match:1", "context:1", "match:1"},
+		},
+		{
+			opts:   nil,
+			expect: []int{2, 4, 10},
+		},
+	}
+	for i, cas := range cases {
+		var expect []string
+		for _, j := range cas.expect {
+			expect = append(expect, fmt.Sprintf(`[printer.go:41] ["line %d"]`, j))
+		}
+		s.searchOpts = cas.opts
+		messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{Levels: []pb.LogLevel{pb.LogLevel_Error}})
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, expect, got, "case %d", i)
+		require.Equal(t, cas.context, trailer.Get(sysutil.SearchLogContextKey), "case %d", i)
+	}
+}
+
+func TestSearchLogHighlights(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [INFO] [gc_worker.go:230] ["[gc worker] start"] [conn=1]`,
+		`[2019/08/26 06:19:15.011 -04:00] [ERROR] [misc.go:91] ["panic"] [conn=2]`,
+		`[2019/08/26 06:19:16.011 -04:00] [WARN] [session.go:1014] ["txn conflict, retry"] [conn=1]`,
+	})
+
+	cases := []struct {
+		patterns []string
+		query    string
+		expect   [][]string // the highlighted text of each returned message
+	}{
+		{patterns: []string{"gc"}, expect: [][]string{{"gc", "gc"}}},
+		{patterns: []string{`conn=\d`, "!panic"}, expect: [][]string{{"conn=1"}, {"conn=1"}}},
+		{patterns: []string{"~WELCOME", "|panic"}, expect: [][]string{{"Welcome"}, {"panic"}}},
+		{patterns: []string{"(?i)TXN CON", "conflict"}, expect: [][]string{{"txn conflict"}}},
+		{patterns: []string{"!gc", `z*`}, expect: [][]string{nil, nil, nil}},
+		{query: `level:error OR (retry AND NOT /t\w+/)`, expect: [][]string{nil}},
+		{query: `/co\w+/ AND (start OR NOT retry)`, expect: [][]string{{"come"}, {"start", "conn"}, {"conn"}}},
+	}
+	for i, cas := range cases {
+		s.searchOpts = []sysutil.SearchLogOption{sysutil.WithHighlights()}
+		if cas.query != "" {
+			query, err := sysutil.ParseLogQuery(cas.query)
+			require.NoError(t, err)
+			s.searchOpts = append(s.searchOpts, sysutil.WithQuery(query))
+		}
+		messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{Patterns: cas.patterns})
+		got := make([][]string, len(messages))
+		for _, value := range trailer.Get(sysutil.SearchLogHighlightsKey) {
+			parts := strings.SplitN(value, ":", 2)
+			index, err := strconv.Atoi(parts[0])
+			require.NoError(t, err)
+			for _, r := range strings.Split(parts[1], ",") {
+				var start, end int
+				_, err := fmt.Sscanf(r, "%d-%d", &start, &end)
+				require.NoError(t, err)
+				got[index] = append(got[index], messages[index].Message[start:end])
+			}
+		}
+		require.Equal(t, cas.expect, got, "case %d", i)
+	}
+
+	// the highlights of the Go API
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"))
+	search, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{Patterns: []string{"conn", "n=", "|x"}}, sysutil.WithHighlights())
+	require.NoError(t, err)
+	defer search.Close()
+	entry, err := search.Next()
+	require.NoError(t, err)
+	// the overlapping matches of "conn" and "n=" are merged
+	require.Equal(t, []sysutil.LogRange{{Start: 42, End: 47}}, entry.Highlights)
+	require.Equal(t, "conn=", entry.Message[42:47])
+}
+
+func TestSearchLogTrailerLimit(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, i))
+	}
+	s.writeTmpFile(t, "rpc.tidb.log", lines)
+
+	// the highlights of the first messages are sent
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithHighlights()}
+	messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{Patterns: []string{"TiDB"}})
+	require.Len(t, messages, 1000)
+	highlights := trailer.Get(sysutil.SearchLogHighlightsKey)
+	require.Less(t, len(highlights), 1000)
+	size := 0
+	for i, value := range highlights {
+		require.Equal(t, fmt.Sprintf("%d:29-33", i), value)
+		size += len(value)
+	}
+	require.LessOrEqual(t, size, sysutil.MaxSearchLogTrailerSize)
+	require.Equal(t, []string{"true"}, trailer.Get(sysutil.SearchLogHighlightsTruncatedKey))
+
+	// not truncated
+	messages, trailer = s.searchLogWithTrailer(t, &pb.SearchLogRequest{Patterns: []string{`line=1\d\]`}})
+	require.Len(t, messages, 10)
+	require.Len(t, trailer.Get(sysutil.SearchLogHighlightsKey), 10)
+	require.Empty(t, trailer.Get(sysutil.SearchLogHighlightsTruncatedKey))
+
+	// the trailer of a followed stream is never sent
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+	for _, opt := range []sysutil.SearchLogOption{sysutil.WithHighlights(), sysutil.WithDedup(0)} {
+		s.searchOpts = []sysutil.SearchLogOption{sysutil.WithFollow(0), opt}
+		stream, err := pb.NewDiagnosticsClient(conn).SearchLog(context.Background(), &pb.SearchLogRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Error(t, err)
+	}
+}
+
+func TestSearchLogDedup(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:10.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=1]`,
+		`[2019/08/26 06:19:11.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=2]`,
+		`[2019/08/26 06:19:12.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=3]`,
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=4]`,
+		`[2019/08/26 06:19:15.011 -04:00] [WARN] [region_cache.go:120] ["region epoch not match"] [region_id=0x5]`,
+		`[2019/08/26 06:19:16.011 -04:00] [ERROR] [region_cache.go:120] ["region epoch not match"] [region_id=6]`,
+	})
+
+	type repeat struct {
+		line     int
+		repeats  int
+		lastLine int
+	}
+	cases := []struct {
+		opts   []sysutil.SearchLogOption
+		expect []repeat
+	}{
+		{
+			opts:   []sysutil.SearchLogOption{sysutil.WithDedup(0)},
+			expect: []repeat{{0, 3, 2}, {3, 1, 3}, {4, 2, 5}, {6, 1, 6}},
+		},
+		{
+			opts:   []sysutil.SearchLogOption{sysutil.WithDedup(4 * time.Second)},
+			expect: []repeat{{0, 4, 4}, {3, 1, 3}, {5, 1, 5}, {6, 1, 6}},
+		},
+		{
+			opts:   []sysutil.SearchLogOption{sysutil.WithDedup(4 * time.Second), sysutil.WithReverse()},
+			expect: []repeat{{6, 1, 6}, {5, 4, 1}, {3, 1, 3}, {0, 1, 0}},
+		},
+		{
+			opts:   []sysutil.SearchLogOption{sysutil.WithDedup(0), sysutil.WithLimit(2)},
+			expect: []repeat{{0, 3, 2}, {3, 1, 3}},
+		},
+	}
+	for i, cas := range cases {
+		var expect []string
+		var expectRepeats []string
+		for j, r := range cas.expect {
+			item, err := sysutil.ParseLogItem(s.readTmpFileLine(t, "rpc.tidb.log", r.line))
+			require.NoError(t, err)
+			expect = append(expect, item.Message)
+			if r.repeats > 1 {
+				expectRepeats = append(expectRepeats, fmt.Sprintf("%d:%d:%d", j, r.repeats, s.itemTime(t, "rpc.tidb.log", r.lastLine)))
+			}
+		}
+		s.searchOpts = cas.opts
+		messages, trailer := s.searchLogWithTrailer(t, &pb.SearchLogRequest{})
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, expect, got, "case %d", i)
+		require.Equal(t, expectRepeats, trailer.Get(sysutil.SearchLogRepeatsKey), "case %d", i)
+	}
+
+	// the repeats of the Go API
+	d := sysutil.NewDiagnosticsServer(filepath.Join(s.tmpDir, "rpc.tidb.log"))
+	search, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{}, sysutil.WithDedup(0))
+	require.NoError(t, err)
+	defer search.Close()
+	entry, err := search.Next()
+	require.NoError(t, err)
+	require.Equal(t, 3, entry.Repeats)
+	require.Equal(t, s.itemTime(t, "rpc.tidb.log", 0), entry.Time)
+	require.Equal(t, s.itemTime(t, "rpc.tidb.log", 2), entry.LastTime)
+}
+
+func TestResumeSearchLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpGzipFile(t, "rpc.tidb-0.log.gz", panicLogLines(0, 100))
+	s.writeTmpFile(t, "rpc.tidb-1.log", panicLogLines(100, 100))
+	// overlapping with the other files
+	s.writeTmpFile(t, "rpc.tidb-copy.log", panicLogLines(150, 100))
+	s.writeTmpFile(t, "rpc.tidb.log", panicLogLines(200, 100))
+
+	path := filepath.Join(s.tmpDir, "rpc.tidb.log")
+	// search returns the items and the cursor after them
+	search := func(parallelism, limit int, cursor string, opts ...sysutil.SearchLogOption) ([]string, string) {
+		d := sysutil.NewDiagnosticsServer(path, sysutil.WithSearchLogParallelism(parallelism))
+		opts = append(opts, sysutil.WithLimit(limit))
+		if cursor != "" {
+			opts = append(opts, sysutil.WithCursor(cursor))
+		}
+		search, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{}, opts...)
+		require.NoError(t, err)
+		defer search.Close()
+		var messages []string
+		for {
+			entry, err := search.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			messages = append(messages, fmt.Sprintf("%d %s %v", entry.Time, entry.Message, entry.Context))
+		}
+		cursor, err = search.Cursor()
+		require.NoError(t, err)
+		return messages, cursor
+	}
+
+	cases := [][]sysutil.SearchLogOption{
+		nil,
+		{sysutil.WithMultilineAggregation(0)},
+		{sysutil.WithQuery(mustParseLogQuery(t, `panic OR line=13 OR line=17`)), sysutil.WithContext(2, 1)},
+	}
+	for i, opts := range cases {
+		expect, _ := search(1, -1, "", opts...)
+		for _, parallelism := range []int{1, 3} {
+			var got []string
+			var cursor string
+			for n := 0; n < 100; n++ {
+				messages, next := search(parallelism, 7, cursor, opts...)
+				got = append(got, messages...)
+				if len(messages) == 0 {
+					break
+				}
+				cursor = next
+			}
+			require.Equal(t, expect, got, "case %d", i)
+		}
+	}
+
+	// resumed after the active file is rotated
+	req := &pb.SearchLogRequest{Patterns: []string{`line=[23]\d\d\]`}}
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithLimit(75)}
+	messages, trailer := s.searchLogWithTrailer(t, req)
+	require.Len(t, trailer.Get(sysutil.SearchLogCursorKey), 1)
+	require.NoError(t, os.Rename(path, filepath.Join(s.tmpDir, "rpc.tidb-2.log")))
+	s.writeTmpFile(t, "rpc.tidb.log", panicLogLines(300, 10))
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithCursor(trailer.Get(sysutil.SearchLogCursorKey)[0])}
+	messages = append(messages, s.searchLog(t, req)...)
+	var expect, lines []int
+	for i := 200; i < 310; i++ {
+		expect = append(expect, i)
+		// the lines of the copied file
+		if i < 250 {
+			expect = append(expect, i)
+		}
+	}
+	for _, m := range messages {
+		var line int
+		_, err := fmt.Sscanf(m.Message[strings.Index(m.Message, "line=")+len("line="):], "%d", &line)
+		require.NoError(t, err)
+		lines = append(lines, line)
+	}
+	require.Equal(t, expect, lines)
+
+	d := sysutil.NewDiagnosticsServer(path)
+	_, err := d.NewLogSearch(context.Background(), &pb.SearchLogRequest{}, sysutil.WithCursor("invalid"))
+	require.Error(t, err)
+	_, err = d.NewLogSearch(context.Background(), &pb.SearchLogRequest{}, sysutil.WithCursor("e30"), sysutil.WithReverse())
+	require.Error(t, err)
+}
+
+func mustParseLogQuery(t *testing.T, s string) *sysutil.LogQuery {
+	query, err := sysutil.ParseLogQuery(s)
+	require.NoError(t, err)
+	return query
+}
+
+// slowLogParser parses the unified log, and sleeps before the lines
+// containing "slow".
+type slowLogParser struct {
+	sysutil.UnifiedLogParser
+	delay time.Duration
+}
+
+func (p slowLogParser) ParseLogItem(line string) (*pb.LogMessage, error) {
+	if strings.Contains(line, "slow") {
+		time.Sleep(p.delay)
+	}
+	return p.UnifiedLogParser.ParseLogItem(line)
+}
+
+func TestSearchLogBatching(t *testing.T) {
+	s, clean := createSearchLogSuite(t,
+		sysutil.WithSearchLogBatchSize(1000),
+		sysutil.WithMaxLogMessageSize(40),
+		sysutil.WithLogParser(slowLogParser{delay: 500 * time.Millisecond}),
+		sysutil.WithSearchLogFlushInterval(20*time.Millisecond))
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:%02d.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, 10+i, i))
+	}
+	// truncated without breaking the characters
+	lines = append(lines, `[2019/08/26 06:19:40.011 -04:00] [INFO] [printer.go:41] ["你好你好你好你好你好你好你好"]`)
+	// sent after a slow line, the previous item is held until the next
+	// item of the file is read
+	lines = append(lines, `[2019/08/26 06:19:41.011 -04:00] [INFO] [printer.go:41] ["slow"]`)
+	s.writeTmpFile(t, "rpc.tidb.log", lines)
+
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+	s.searchOpts = []sysutil.SearchLogOption{sysutil.WithHighlights()}
+	stream, err := pb.NewDiagnosticsClient(conn).SearchLog(context.Background(), &pb.SearchLogRequest{
+		StartTime: 1566814752011,
+		Patterns:  []string{"TiDB|你好|slow"},
+	})
+	require.NoError(t, err)
+
+	// the batches are limited by size
+	var messages []*pb.LogMessage
+	var batches int
+	for len(messages) < 28 {
+		res, err := stream.Recv()
+		require.NoError(t, err, "after %d messages", len(messages))
+		size := 0
+		for _, m := range res.Messages {
+			size += m.Size()
+		}
+		require.LessOrEqual(t, size, 1000)
+		messages = append(messages, res.Messages...)
+		batches++
+	}
+	require.Len(t, messages, 28)
+	require.Greater(t, batches, 1)
+	require.Equal(t, `[printer.go:41] ["Welcome to TiDB."] [li`+sysutil.LogMessageTruncatedMarker, messages[0].Message)
+
+	// the rest are sent by the next flush
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []*pb.LogMessage{
+		{Time: 1566814780011, Level: pb.LogLevel_Info, Message: `[printer.go:41] ["你好你好你好你` + sysutil.LogMessageTruncatedMarker},
+		{Time: 1566814781011, Level: pb.LogLevel_Info, Message: `[printer.go:41] ["slow"]`},
+	}, res.Messages)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	// the highlights are clipped
+	highlights := stream.Trailer().Get(sysutil.SearchLogHighlightsKey)
+	require.Len(t, highlights, 30)
+	require.Equal(t, "0:29-33", highlights[0])
+	require.Equal(t, "28:18-39", highlights[28])
+	require.Equal(t, "29:18-22", highlights[29])
+}
+
+func TestSearchLogThrottle(t *testing.T) {
+	var lines []string
+	for i := 0; i < 400; i++ {
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:%02d.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d] [padding=%s]`, i/10, i, strings.Repeat("x", 20)))
+	}
+	// the slow lines take 5ms each to parse
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:40.011 -04:00] [INFO] [printer.go:41] ["slow"] [line=%d]`, i))
+	}
+
+	cases := []struct {
+		opts    []sysutil.DiagnosticsServerOption
+		reverse bool
+		minimum time.Duration
+	}{
+		// 48 KiB at 64 KiB/s with the burst of 6.4 KiB
+		{opts: []sysutil.DiagnosticsServerOption{sysutil.WithSearchLogReadRate(64 * 1024)}, minimum: 500 * time.Millisecond},
+		{opts: []sysutil.DiagnosticsServerOption{sysutil.WithSearchLogReadRate(64 * 1024)}, reverse: true, minimum: 500 * time.Millisecond},
+		// 100ms busy at the duty cycle of 20%
+		{opts: []sysutil.DiagnosticsServerOption{sysutil.WithSearchLogDutyCycle(0.2)}, minimum: 300 * time.Millisecond},
+	}
+	for i, cas := range cases {
+		s, clean := createSearchLogSuite(t, append(cas.opts, sysutil.WithLogParser(slowLogParser{delay: 5 * time.Millisecond}))...)
+		s.writeTmpFile(t, "rpc.tidb.log", lines)
+		s.searchOpts = []sysutil.SearchLogOption{sysutil.WithLimit(-1)}
+		if cas.reverse {
+			s.searchOpts = append(s.searchOpts, sysutil.WithReverse())
+		}
+
+		start := time.Now()
+		messages := s.searchLog(t, &pb.SearchLogRequest{StartTime: 1566814740011})
+		require.GreaterOrEqual(t, time.Since(start), cas.minimum, "case %d", i)
+		require.Len(t, messages, len(lines), "case %d", i)
+		clean()
+	}
+}
+
+func TestResolveFilesThrottle(t *testing.T) {
+	s, clean := createSearchLogSuite(t, sysutil.WithSearchLogReadRate(64*1024))
+	defer clean()
+
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf(`[2019/08/26 06:19:%02d.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, i/2, i))
+	}
+	// the files are read to resolve their time range, but none of them is
+	// searched
+	for i := 0; i < 16; i++ {
+		s.writeTmpFile(t, fmt.Sprintf("rpc.tidb-%d.log", i), lines)
+	}
+
+	start := time.Now()
+	messages := s.searchLog(t, &pb.SearchLogRequest{StartTime: 1566814800011})
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	require.Len(t, messages, 0)
+}
+
+func TestSearchLogPatterns(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/08/26 06:19:13.011 -04:00] [INFO] [printer.go:41] ["Welcome to TiDB."]`,
+		`[2019/08/26 06:19:14.011 -04:00] [INFO] [gc_worker.go:230] ["[gc worker] start"] [conn=1]`,
+		`[2019/08/26 06:19:15.011 -04:00] [ERROR] [misc.go:91] ["panic"] [conn=2]`,
+		`[2019/08/26 06:19:16.011 -04:00] [WARN] [session.go:1014] ["txn conflict, retry"] [conn=1]`,
+		`[2019/08/26 06:19:17.011 -04:00] [WARN] [session.go:1014] ["!important"]`,
+		"[2019/08/26 06:19:18.011 -04:00] [WARN] [session.go:1014] [\"\u212aill query\"]",
+	})
+
+	cases := []struct {
+		patterns []string
+		expect   []int
+	}{
+		{patterns: []string{"gc"}, expect: []int{1}},
+		{patterns: []string{"!gc", "!conn"}, expect: []int{0, 4, 5}},
+		{patterns: []string{"~WELCOME"}, expect: []int{0}},
+		{patterns: []string{"(?i)TXN"}, expect: []int{3}},
+		{patterns: []string{"panic", "|conflict"}, expect: []int{2, 3}},
+		{patterns: []string{"conn=1", "gc", "|conflict"}, expect: []int{1, 3}},
+		{patterns: []string{"|conflict", "conn=1"}, expect: []int{3}},
+		{patterns: []string{`\Q[conn=1]\E`}, expect: []int{1, 3}},
+		{patterns: []string{`\!important`}, expect: []int{4}},
+		{patterns: []string{"!~WELCOME|important|kill", "!~conn"}, expect: []int{}},
+		// matched by regular expression since K folds to the Kelvin sign
+		{patterns: []string{"~KILL"}, expect: []int{5}},
+		{patterns: []string{`conn=\d`, "!(?i)TXN"}, expect: []int{1, 2}},
+	}
+	for i, cas := range cases {
+		var expect []string
+		for _, j := range cas.expect {
+			item, err := sysutil.ParseLogItem(s.readTmpFileLine(t, "rpc.tidb.log", j))
+			require.NoError(t, err)
+			expect = append(expect, item.Message)
+		}
+		var got []string
+		for _, m := range s.searchLog(t, &pb.SearchLogRequest{Patterns: cas.patterns}) {
+			got = append(got, m.Message)
+		}
+		require.Equal(t, expect, got, "case %d", i)
+	}
+
+	conn, err := grpc.Dial(s.address, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := pb.NewDiagnosticsClient(conn).SearchLog(context.Background(), &pb.SearchLogRequest{Patterns: []string{"!("}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Error(t, err)
+}
+
 func TestParseLogLevel(t *testing.T) {
 	cases := []struct {
 		s string
@@ -703,8 +1816,9 @@ func TestCompressLog(t *testing.T) {
 		patterns      []string
 	}{
 		{
+			// The compressed file2 isn't pruned until it's indexed by a search
 			search:        timeRange{"2019/08/26 06:22:14.000 -04:00", "2019/08/26 06:22:16.000 -04:00"},
-			expectFileNum: 1,
+			expectFileNum: 2,
 			levels:        []pb.LogLevel{pb.LogLevel_Info},
 			patterns:      []string{".*TiDB.*"},
 			expect: []string{
@@ -759,10 +1873,10 @@ func TestCompressLog(t *testing.T) {
 			},
 		},
 		{
-			// When file1.endtime < search.start < file2.begintime,
-			// it will scan one more file, because we don't now the last item for a compressed file.
+			// When file1.endtime < search.start < file2.begintime, the compressed
+			// file1 is pruned by the end time in its sidecar index.
 			search:        timeRange{"2019/08/26 06:22:13.000 -04:00", "2019/08/26 06:22:20.000 -04:00"},
-			expectFileNum: 3,
+			expectFileNum: 2,
 			levels:        []pb.LogLevel{pb.LogLevel_Info},
 			patterns:      []string{".*TiDB.*"},
 			expect: []string{
@@ -787,7 +1901,7 @@ func TestCompressLog(t *testing.T) {
 		endTime, err := sysutil.ParseTimeStamp(cas.search.end)
 		require.NoError(t, err)
 
-		logfile, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "rpc.tidb.log"), beginTime, endTime)
+		logfile, err := sysutil.ResolveFiles(context.Background(), filepath.Join(s.tmpDir, "rpc.tidb.log"), sysutil.UnifiedLogParser{}, beginTime, endTime)
 		require.NoError(t, err)
 		require.Len(t, logfile, cas.expectFileNum)
 
@@ -888,6 +2002,195 @@ func BenchmarkReadLastLinesOfHugeLine(b *testing.B) {
 	}
 }
 
+// logStart is the time of the first item of the generated log lines.
+var logStart = time.Date(2019, 8, 26, 6, 0, 0, 0, time.FixedZone("", -4*3600))
+
+// toMillis converts the time to unix milliseconds.
+func toMillis(tt time.Time) int64 {
+	return tt.UnixNano() / int64(time.Millisecond)
+}
+
+// atSecond returns the time sec seconds after logStart.
+func atSecond(sec int) time.Time {
+	return logStart.Add(time.Duration(sec) * time.Second)
+}
+
+// atMinute returns the time min minutes after logStart.
+func atMinute(min int) time.Time {
+	return logStart.Add(time.Duration(min) * time.Minute)
+}
+
+// secondlyLogLines returns log lines with one item per second starting from
+// logStart, and a continuation line every 100 items.
+func secondlyLogLines(lines int) (time.Time, []string) {
+	content := make([]string, 0, lines)
+	for i := 0; i < lines; i++ {
+		ts := atSecond(i).Format(sysutil.TimeStampLayout)
+		content = append(content, fmt.Sprintf(`[%s] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, ts, i))
+		if i%100 == 0 {
+			content = append(content, `goroutine 1 [running]:`)
+		}
+	}
+	return logStart, content
+}
+
+// minutelyLogLines returns the log lines of the message with one item per
+// minute in the minutes [from, to) after logStart.
+func minutelyLogLines(from, to int, message string) []string {
+	var lines []string
+	for i := from; i < to; i++ {
+		lines = append(lines, fmt.Sprintf(`[%s] [INFO] [printer.go:41] [%q] [min=%d]`, atMinute(i).Format(sysutil.TimeStampLayout), message, i))
+	}
+	return lines
+}
+
+// leveledLogLines returns n log lines with one item per second from the
+// second from after logStart, every 7th item is an error.
+func leveledLogLines(from, n int) []string {
+	var lines []string
+	for i := from; i < from+n; i++ {
+		level := "INFO"
+		if i%7 == 0 {
+			level = "ERROR"
+		}
+		lines = append(lines, fmt.Sprintf(`[%s] [%s] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, atSecond(i).Format(sysutil.TimeStampLayout), level, i))
+	}
+	return lines
+}
+
+// panicLogLines returns n log lines with one item per second from the second
+// from after logStart, every 5th item is a panic with a continuation line.
+func panicLogLines(from, n int) []string {
+	var lines []string
+	for i := from; i < from+n; i++ {
+		ts := atSecond(i).Format(sysutil.TimeStampLayout)
+		if i%5 == 0 {
+			lines = append(lines, fmt.Sprintf(`[%s] [ERROR] [misc.go:91] ["panic"] [line=%d]`, ts, i), "goroutine 1 [running]:")
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`[%s] [INFO] [printer.go:41] ["Welcome to TiDB."] [line=%d]`, ts, i))
+	}
+	return lines
+}
+
+// writeSecondlyLogFile writes the secondlyLogLines to the file and returns
+// the time of the first item.
+func (s *searchLogSuite) writeSecondlyLogFile(t testing.TB, filename string, lines int) time.Time {
+	start, content := secondlyLogLines(lines)
+	s.writeTmpFile(t, filename, content)
+	return start
+}
+
+func TestSeekToTime(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	const lines = 20000
+	start := s.writeSecondlyLogFile(t, "tidb.log", lines)
+	path := filepath.Join(s.tmpDir, "tidb.log")
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, file.Close())
+	}()
+
+	for _, i := range []int{-10, 0, 1, 99, 100, 101, 5000, 12345, lines - 1, lines, lines + 10} {
+		ts := toMillis(start.Add(time.Duration(i) * time.Second))
+		offset, err := sysutil.SeekToTime(context.Background(), file, sysutil.UnifiedLogParser{}, ts)
+		require.NoError(t, err)
+		if i > 1000 {
+			require.Greater(t, offset, int64(0), "line %d", i)
+		}
+
+		// the first item after the offset must not be later than ts
+		if i <= 0 {
+			require.Equal(t, int64(0), offset)
+		}
+		_, err = file.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		reader := bufio.NewReader(file)
+		if offset > 0 {
+			_, err = reader.ReadString('\n')
+			require.NoError(t, err)
+		}
+		for {
+			line, err := reader.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if item, err := sysutil.ParseLogItem(strings.TrimSpace(line)); err == nil && i > 0 {
+				require.LessOrEqual(t, item.Time, ts, "line %d", i)
+				break
+			}
+		}
+
+		count, err := sysutil.CountLogs(context.Background(), path, ts, math.MaxInt64)
+		require.NoError(t, err)
+		expected := lines - i
+		if i < 0 {
+			expected = lines
+		} else if i >= lines {
+			expected = 0
+		}
+		// continuation lines are counted as items
+		for j := 0; j < lines; j += 100 {
+			if j >= i {
+				expected++
+			}
+		}
+		require.Equal(t, expected, count, "line %d", i)
+	}
+}
+
+func benchmarkRecentLogs(b *testing.B, search func(path string, begin int64) int) {
+	s, clean := createSearchLogSuite(b)
+	defer clean()
+
+	// about 20MB, 2.7 days of logs
+	const lines = 240000
+	start := s.writeSecondlyLogFile(b, "tidb.log", lines)
+	path := filepath.Join(s.tmpDir, "tidb.log")
+	// the last five minutes
+	begin := start.Add((lines-300)*time.Second).UnixNano() / int64(time.Millisecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if count := search(path, begin); count < 300 {
+			b.Fatalf("expect at least 300 items, got %d", count)
+		}
+	}
+}
+
+func BenchmarkSearchRecentLogs(b *testing.B) {
+	benchmarkRecentLogs(b, func(path string, begin int64) int {
+		count, err := sysutil.CountLogs(context.Background(), path, begin, math.MaxInt64)
+		require.NoError(b, err)
+		return count
+	})
+}
+
+// BenchmarkScanRecentLogs scans the logs from the beginning of the file,
+// which is the way before seeking by bisection.
+func BenchmarkScanRecentLogs(b *testing.B) {
+	benchmarkRecentLogs(b, func(path string, begin int64) int {
+		file, err := os.Open(path)
+		require.NoError(b, err)
+		defer file.Close()
+		var count int
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadString('\n')
+			if item, err := sysutil.ParseLogItem(strings.TrimSpace(line)); err == nil && item.Time >= begin {
+				count++
+			}
+			if err == io.EOF {
+				return count
+			}
+		}
+	})
+}
+
 // run benchmark by `go test -check.b`
 // result:
 // searchLogSuite.BenchmarkReadLastLines      1000000              2008 ns/op
@@ -898,3 +2201,6 @@ func BenchmarkReadLastLinesOfHugeLine(b *testing.B) {
 // result for the old readLastLine method when last line is 76*2 bytes long:
 // searchLogSuite.BenchmarkReadLastLine        10000            247836 ns/op
 // searchLogSuite.BenchmarkReadLastLine        10000            251958 ns/op
+// result for searching the last five minutes of a 20MB log file:
+// BenchmarkSearchRecentLogs          5            803975 ns/op
+// BenchmarkScanRecentLogs            5         204892723 ns/op
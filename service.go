@@ -16,97 +16,827 @@ package sysutil
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"regexp"
 	"runtime"
 	"sort"
+	"strings"
+	"time"
 
 	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
 	"github.com/pingcap/log"
+	"google.golang.org/grpc/metadata"
 )
 
 type DiagnosticsServer struct {
-	logFile string
+	logFile        string
+	logParser      LogParser
+	slowLogFile    string
+	sources        []LogSource
+	searchLogLimit int
+	parallelism    int
+	batchSize      int
+	maxMessageSize int
+	flushInterval  time.Duration
+	throttle       logThrottle
 }
 
-func NewDiagnosticsServer(logFile string) *DiagnosticsServer {
-	return &DiagnosticsServer{
+const (
+	// DefaultSearchLogLimit is the default maximum number of items returned by a log search
+	DefaultSearchLogLimit = 64 * 1024
+	// SearchLogTruncatedKey is the key of the stream trailer metadata, which is
+	// set to "true" if the search stops at the limit and more items match.
+	SearchLogTruncatedKey = "search-log-truncated"
+	// SearchLogSourcesKey is the key of the stream trailer metadata, which is
+	// set if the search targets the log sources by WithSources or
+	// WithAllSources. Each value is `<source>:<count>` in order, which means
+	// the next count items are read from the source.
+	SearchLogSourcesKey = "search-log-sources"
+	// SearchLogContextKey is the key of the stream trailer metadata, which is
+	// set if the search returns context items by WithContext. Each value is
+	// `match:<count>` or `context:<count>` in order, which means the next
+	// count items are matched items or context items.
+	SearchLogContextKey = "search-log-context"
+	// SearchLogHighlightsKey is the key of the stream trailer metadata, which
+	// is set if the search reports the matched byte ranges by WithHighlights.
+	// Each value is `<index>:<start>-<end>[,<start>-<end>...]`, which means
+	// the byte ranges [start, end) of the message are matched, the index is
+	// the position of the message in the stream starting from 0.
+	SearchLogHighlightsKey = "search-log-highlights"
+	// SearchLogRepeatsKey is the key of the stream trailer metadata, which is
+	// set if the search collapses the repeated items by WithDedup. Each value
+	// is `<index>:<count>:<last time>`, which means the message is repeated
+	// count times until the last time in unix milliseconds, the index is the
+	// position of the message in the stream starting from 0. The messages not
+	// repeated are omitted.
+	SearchLogRepeatsKey = "search-log-repeats"
+	// SearchLogHighlightsTruncatedKey and SearchLogRepeatsTruncatedKey are
+	// the keys of the stream trailer metadata, which are set to "true" if the
+	// values of SearchLogHighlightsKey or SearchLogRepeatsKey are truncated at
+	// MaxSearchLogTrailerSize. The values of the messages after the last one
+	// sent are unknown.
+	SearchLogHighlightsTruncatedKey = "search-log-highlights-truncated"
+	SearchLogRepeatsTruncatedKey    = "search-log-repeats-truncated"
+	// MaxSearchLogTrailerSize is the maximum size in bytes of the values of
+	// SearchLogHighlightsKey and SearchLogRepeatsKey in total, so that the
+	// trailer doesn't exceed the metadata size limit of the clients.
+	MaxSearchLogTrailerSize = 4 * 1024
+	// SearchLogCursorKey is the key of the stream trailer metadata, which is
+	// the cursor to resume the search by WithCursor, see LogSearch.Cursor.
+	SearchLogCursorKey = "search-log-cursor"
+)
+
+const (
+	// DefaultSearchLogBatchSize is the default maximum size in bytes of the
+	// messages sent by SearchLog in a response
+	DefaultSearchLogBatchSize = 1024 * 1024
+	// DefaultMaxLogMessageSize is the default maximum size in bytes of a
+	// message sent by SearchLog
+	DefaultMaxLogMessageSize = 1024 * 1024
+	// DefaultSearchLogFlushInterval is the default interval to send the
+	// matched items of a slow search before the batch is full
+	DefaultSearchLogFlushInterval = time.Second
+	// LogMessageTruncatedMarker is appended to the messages truncated by
+	// SearchLog
+	LogMessageTruncatedMarker = "...(truncated)"
+)
+
+const (
+	// MainLogSource is the name of the log source of the log file passed to
+	// NewDiagnosticsServer.
+	MainLogSource = "main"
+	// SlowLogSource is the name of the log source of the slow log file.
+	SlowLogSource = "slow"
+)
+
+// LogSource is a named log file, and its rotated files are searched as well.
+type LogSource struct {
+	Name   string
+	Path   string
+	Parser LogParser
+}
+
+// DiagnosticsServerOption configures a DiagnosticsServer.
+type DiagnosticsServerOption func(*DiagnosticsServer)
+
+// WithLogParser sets the parser used to parse the log lines of the log
+// file, the unified log format is used if not specified.
+func WithLogParser(parser LogParser) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.logParser = parser
+	}
+}
+
+// WithSlowLogFile sets the path of the TiDB slow query log file, which is
+// searched when the target of the search request is SearchLogRequest_Slow.
+func WithSlowLogFile(slowLogFile string) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.slowLogFile = slowLogFile
+	}
+}
+
+// WithLogSource registers an extra log source, e.g. the stderr log or the
+// audit log, which is searched by WithSources or WithAllSources. The unified
+// log format is used if parser is nil. The names MainLogSource and
+// SlowLogSource are reserved.
+func WithLogSource(name, path string, parser LogParser) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		if parser == nil {
+			parser = UnifiedLogParser{}
+		}
+		d.sources = append(d.sources, LogSource{Name: name, Path: path, Parser: parser})
+	}
+}
+
+// WithSearchLogLimit sets the default maximum number of items returned by a
+// log search, DefaultSearchLogLimit is used if limit is 0 and a negative
+// limit means unlimited.
+func WithSearchLogLimit(limit int) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.searchLogLimit = limit
+	}
+}
+
+// WithSearchLogParallelism sets the maximum number of log files scanned
+// concurrently by a log search, so that the search doesn't starve the host
+// process. Half of the CPUs are used if n is 0, and the files are scanned one
+// by one if n is 1.
+func WithSearchLogParallelism(n int) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.parallelism = n
+	}
+}
+
+// WithSearchLogBatchSize sets the maximum size in bytes of the messages sent
+// by SearchLog in a response, so that a response doesn't exceed the maximum
+// message size of gRPC. DefaultSearchLogBatchSize is used if size is 0. A
+// message larger than the size is sent alone.
+func WithSearchLogBatchSize(size int) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.batchSize = size
+	}
+}
+
+// WithMaxLogMessageSize sets the maximum size in bytes of a message sent by
+// SearchLog, the longer messages are truncated and end with
+// LogMessageTruncatedMarker. DefaultMaxLogMessageSize is used if size is 0
+// and a negative size means unlimited.
+func WithMaxLogMessageSize(size int) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.maxMessageSize = size
+	}
+}
+
+// WithSearchLogFlushInterval sets the interval to send the matched items of a
+// slow search before the batch is full, DefaultSearchLogFlushInterval is
+// used if interval is 0.
+func WithSearchLogFlushInterval(interval time.Duration) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.flushInterval = interval
+	}
+}
+
+// WithSearchLogReadRate limits the bytes read from the log files per second
+// by all the log searches of the server, so that the searches don't compete
+// with the host process for the disk. The compressed files are limited by
+// the compressed size. The read rate is unlimited if rate is 0.
+func WithSearchLogReadRate(rate int64) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.throttle.readRate = nil
+		if rate > 0 {
+			d.throttle.readRate = newRateLimiter(float64(rate))
+		}
+	}
+}
+
+// WithSearchLogDutyCycle limits the time that the log searches of the server
+// are busy to the fraction duty of each second, e.g. 0.2 lets the files be
+// scanned for 200ms of a second of a CPU. The duty cycle is unlimited if duty
+// is 0 or not less than 1.
+func WithSearchLogDutyCycle(duty float64) DiagnosticsServerOption {
+	return func(d *DiagnosticsServer) {
+		d.throttle.dutyCycle = nil
+		if duty > 0 && duty < 1 {
+			d.throttle.dutyCycle = newRateLimiter(duty)
+		}
+	}
+}
+
+func NewDiagnosticsServer(logFile string, opts ...DiagnosticsServerOption) *DiagnosticsServer {
+	d := &DiagnosticsServer{
 		logFile: logFile,
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
-// SearchLog implements the DiagnosticsServer interface.
-func (d *DiagnosticsServer) SearchLog(req *pb.SearchLogRequest, stream pb.Diagnostics_SearchLogServer) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			buf := make([]byte, 4096)
-			stackSize := runtime.Stack(buf, false)
-			buf = buf[:stackSize]
-			err = fmt.Errorf(fmt.Sprintf("search log panic, %v, stack is %v", r, string(buf)))
-			log.Error(err.Error())
+func (d *DiagnosticsServer) parser() LogParser {
+	if d.logParser == nil {
+		return UnifiedLogParser{}
+	}
+	return d.logParser
+}
+
+func (d *DiagnosticsServer) searchLogParallelism() int {
+	if d.parallelism > 0 {
+		return d.parallelism
+	}
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// LogSources returns the configured log sources of the server, the main log
+// and the slow log come first.
+func (d *DiagnosticsServer) LogSources() []LogSource {
+	var sources []LogSource
+	for _, name := range []string{MainLogSource, SlowLogSource} {
+		if src, _ := d.logSource(name); src.Path != "" {
+			sources = append(sources, src)
 		}
-	}()
+	}
+	for _, src := range d.sources {
+		if src.Name != MainLogSource && src.Name != SlowLogSource {
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
+
+func (d *DiagnosticsServer) logSource(name string) (LogSource, bool) {
+	switch name {
+	case MainLogSource:
+		return LogSource{Name: MainLogSource, Path: d.logFile, Parser: d.parser()}, true
+	case SlowLogSource:
+		return LogSource{Name: SlowLogSource, Path: d.slowLogFile, Parser: SlowLogParser{}}, true
+	}
+	for _, src := range d.sources {
+		if src.Name == name {
+			return src, true
+		}
+	}
+	return LogSource{}, false
+}
+
+// SearchLogOption configures a single log search.
+type SearchLogOption func(*searchLogConfig)
+
+type searchLogConfig struct {
+	fieldFilters   []LogField
+	query          *LogQuery
+	multiline      bool
+	maxRecordSize  int
+	limit          int
+	reverse        bool
+	follow         bool
+	followInterval time.Duration
+	sources        []string
+	allSources     bool
+	contextBefore  int
+	contextAfter   int
+	highlighted    bool
+	histogram      time.Duration
+	dedup          bool
+	dedupWindow    time.Duration
+	cursor         string
+}
+
+// WithFieldFilter only keeps the logs which have a field named key with
+// exactly the given value, e.g. WithFieldFilter("conn", "123") matches
+// `["conn"=123]`. Multiple field filters must all be satisfied.
+func WithFieldFilter(key, value string) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.fieldFilters = append(c.fieldFilters, LogField{Key: key, Value: value})
+	}
+}
+
+// WithQuery only keeps the logs matching the query, see ParseLogQuery. The
+// query is evaluated in addition to the levels and patterns of the request.
+func WithQuery(query *LogQuery) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.query = query
+	}
+}
+
+// WithMultilineAggregation appends the continuation lines, e.g. stack traces
+// and multi-line SQL, to the message of the preceding item before filtering,
+// so that a pattern matching any line returns the whole item. The lines
+// beyond maxSize bytes of an item are dropped, and a line of
+// LogMessageTruncatedMarker is appended instead. A default size of 1MiB is
+// used if maxSize <= 0.
+func WithMultilineAggregation(maxSize int) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.multiline = true
+		c.maxRecordSize = maxSize
+	}
+}
+
+// WithLimit overrides the maximum number of items returned by the search, the
+// server default is used if limit is 0 and a negative limit means unlimited.
+func WithLimit(limit int) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.limit = limit
+	}
+}
+
+// WithReverse returns the newest items first, the files are walked from the
+// newest to the oldest and the lines are read backwards. Combined with a limit,
+// it returns the last N matched items without scanning the whole time range.
+func WithReverse() SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.reverse = true
+	}
+}
+
+// WithFollow keeps the stream open after the existing logs are read, and
+// streams the lines appended to the active log file like `tail -f`, which is
+// polled every interval (DefaultFollowInterval if interval <= 0). The active
+// file is followed across rotations. The search ends when the stream context
+// is canceled, the limit is reached or an item later than the end time is
+// read. It cannot be combined with WithReverse.
+func WithFollow(interval time.Duration) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.follow = true
+		c.followInterval = interval
+	}
+}
+
+// WithSources searches the named log sources instead of the one selected by
+// the target of the request, the items of all sources are merged by time.
+func WithSources(names ...string) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.sources = append(c.sources, names...)
+	}
+}
+
+// WithAllSources searches all the log sources returned by LogSources.
+func WithAllSources() SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.allSources = true
+	}
+}
+
+// WithContext returns up to before and after unmatched items around each
+// matched item like `grep -B before -A after`, the context items are read
+// from the same file in the time range and count toward the limit.
+func WithContext(before, after int) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.contextBefore = before
+		c.contextAfter = after
+	}
+}
+
+// WithHighlights reports the byte ranges of each matched item matched by the
+// patterns and the query terms, so that the matches can be highlighted with
+// the exact semantics of the search. The excluding patterns and terms are
+// ignored, and the overlapping ranges are merged.
+func WithHighlights() SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.highlighted = true
+	}
+}
+
+// WithHistogram sends the LogHistogram of the search instead of the matched
+// items, which is much cheaper than sending the messages to find the bursts of
+// errors. Each item of the stream is the count of the level in a time bucket,
+// whose time is the start of the bucket and whose message is the count in
+// decimal.
+func WithHistogram(interval time.Duration) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.histogram = interval
+	}
+}
+
+// WithDedup collapses the repeated items, which have the same source, level
+// and message after the numbers, hex strings and IDs are masked like
+// MineLogTemplates, into the first one with the repeat count and the time of
+// the last one. If window is 0, only the consecutive items are collapsed,
+// otherwise the items within window after the first one are collapsed even if
+// other items are in between. The limit counts the collapsed entries.
+func WithDedup(window time.Duration) SearchLogOption {
+	return func(c *searchLogConfig) {
+		c.dedup = true
+		c.dedupWindow = window
+	}
+}
+
+// LogEntry is a log item found by LogSearch.
+type LogEntry struct {
+	*pb.LogMessage
+	// Source is the name of the log source the item is read from.
+	Source string
+	// Context is true if the item doesn't match the search but is returned
+	// as the context of the matched items, see WithContext.
+	Context bool
+	// Highlights are the byte ranges of the message matched by the search in
+	// order, see WithHighlights.
+	Highlights []LogRange
+	// Repeats is the number of the items collapsed into the entry, and
+	// LastTime is the time of the last one in the search order, see
+	// WithDedup. Both are 0 if the items are not collapsed.
+	Repeats  int
+	LastTime int64
+
+	// the position after the item in the pending files, see LogSearch.Cursor
+	rank     int
+	end      int64 // -1 if unknown
+	trailing int
+}
+
+// LogSearch is a log search on the local log files, which returns the items
+// with the information that cannot be carried by SearchLogResponse.
+type LogSearch struct {
+	ctx       context.Context
+	iter      logIterator
+	dedup     *logDeduper
+	limit     int
+	count     int
+	truncated bool
+	// lookahead is the item read after the limit to tell whether the result
+	// is truncated
+	lookahead *LogEntry
+	tagged    bool // the search targets the log sources explicitly
+
+	// the position after the returned items
+	lastTime  int64
+	positions map[int]cursorFile // by the index of the pending files
+}
+
+// NewLogSearch starts a log search with the same semantics as SearchLog, the
+// search must be closed after use.
+//
+// The aggregations of the matched items, e.g. LogHistogram and
+// MineLogTemplates, accept the same options except WithFollow and WithDedup,
+// since the items are neither bounded nor counted one by one then. The limit
+// and the context items are ignored by the aggregations.
+func (d *DiagnosticsServer) NewLogSearch(ctx context.Context, req *pb.SearchLogRequest, opts ...SearchLogOption) (*LogSearch, error) {
+	var cfg searchLogConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.limit == 0 {
+		cfg.limit = d.searchLogLimit
+	}
+	if cfg.limit == 0 {
+		cfg.limit = DefaultSearchLogLimit
+	}
+	if cfg.follow && cfg.reverse {
+		return nil, errors.New("cannot follow logs in reverse")
+	}
+	var cursor *searchCursor
+	if cfg.cursor != "" {
+		if cfg.reverse || cfg.follow || cfg.dedup {
+			return nil, errors.New("cannot resume the search in reverse, follow or dedup mode")
+		}
+		c, err := decodeCursor(cfg.cursor)
+		if err != nil {
+			return nil, err
+		}
+		cursor = c
+	}
 
 	beginTime := req.StartTime
 	endTime := req.EndTime
 	if endTime == 0 {
 		endTime = math.MaxInt64
 	}
-
-	ctx := stream.Context()
-	logFiles, err := resolveFiles(ctx, d.logFile, beginTime, endTime)
-	if err != nil {
-		return err
+	// The items before the last returned one have been returned
+	if cursor != nil && cursor.Time > beginTime {
+		beginTime = cursor.Time
 	}
 
 	var levelFlag int64
 	for _, l := range req.Levels {
 		levelFlag |= 1 << l
 	}
-	var patterns []*regexp.Regexp
-	for _, p := range req.Patterns {
-		re, err := regexp.Compile(p)
+	patterns, err := parseLogPatterns(req.Patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := d.searchSources(req, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	var logFiles []logFile
+	throttle := &cursorThrottle{limits: &d.throttle}
+	for _, src := range sources {
+		files, err := resolveFiles(ctx, src.Path, src.Parser, beginTime, endTime, throttle)
+		if err != nil {
+			for _, f := range logFiles {
+				_ = f.file.Close()
+			}
+			return nil, err
+		}
+		for i := range files {
+			files[i].source = src.Name
+			if cursor != nil {
+				files[i].resume = cursor.position(&files[i])
+			}
+		}
+		logFiles = append(logFiles, files...)
+	}
+
+	s := &LogSearch{
+		ctx:    ctx,
+		limit:  cfg.limit,
+		tagged: cfg.allSources || len(cfg.sources) > 0,
+		iter: logIterator{
+			begin:          beginTime,
+			end:            endTime,
+			levelFlag:      levelFlag,
+			patterns:       patterns,
+			fieldFilters:   cfg.fieldFilters,
+			query:          cfg.query,
+			highlighted:    cfg.highlighted,
+			multiline:      cfg.multiline,
+			maxRecordSize:  cfg.maxRecordSize,
+			reverse:        cfg.reverse,
+			contextBefore:  cfg.contextBefore,
+			contextAfter:   cfg.contextAfter,
+			followInterval: cfg.followInterval,
+			parallelism:    d.searchLogParallelism(),
+			throttle:       &d.throttle,
+			pending:        logFiles,
+		},
+	}
+	if cfg.follow {
+		s.iter.follow = sources
+	}
+	if cfg.dedup {
+		s.dedup = newLogDeduper(int64(cfg.dedupWindow / time.Millisecond))
+	}
+	return s, nil
+}
+
+// parseLogPatterns parses the patterns of the search request. Each pattern is
+// a regular expression with the optional prefixes in order:
+//
+//   - `|` OR-ed with the previous pattern, e.g. ["error", "|panic"] matches
+//     the messages containing either "error" or "panic"
+//   - `!` the messages matching the pattern are excluded
+//   - `~` case-insensitive, the same as `(?i)`
+//
+// A message must match all the patterns which are not OR-ed. A leading `!`,
+// `~` or `|` of the regular expression itself can be escaped by `\`. The
+// patterns which are literal strings, e.g. `gc worker` or `\Q[conn=1]\E`, are
+// matched by substring search instead of regular expression.
+func parseLogPatterns(specs []string) ([][]logPattern, error) {
+	var groups [][]logPattern
+	for _, spec := range specs {
+		or := strings.HasPrefix(spec, "|")
+		if or {
+			spec = spec[1:]
+		}
+		p, err := parseLogPattern(spec)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if or && len(groups) > 0 {
+			groups[len(groups)-1] = append(groups[len(groups)-1], p)
+		} else {
+			groups = append(groups, []logPattern{p})
+		}
+	}
+	return groups, nil
+}
+
+func parseLogPattern(spec string) (logPattern, error) {
+	var p logPattern
+	if strings.HasPrefix(spec, "!") {
+		p.negate = true
+		spec = spec[1:]
+	}
+	fold := false
+	if strings.HasPrefix(spec, "~") {
+		fold = true
+		spec = spec[1:]
+	} else if strings.HasPrefix(spec, "(?i)") {
+		fold = true
+		spec = spec[len("(?i)"):]
+	}
+	re, err := regexp.Compile(spec)
+	if err != nil {
+		return p, err
+	}
+	// The literal with the letters folded to non-ASCII ones, i.e. k and s,
+	// is matched by regular expression.
+	if literal, complete := re.LiteralPrefix(); complete && (!fold || isASCIIFoldable(literal)) {
+		p.literal = literal
+		p.fold = fold
+		return p, nil
+	}
+	if fold {
+		if re, err = regexp.Compile("(?i)" + spec); err != nil {
+			return p, err
+		}
+	}
+	p.re = re
+	return p, nil
+}
+
+// searchSources returns the log sources targeted by the search.
+func (d *DiagnosticsServer) searchSources(req *pb.SearchLogRequest, cfg *searchLogConfig) ([]LogSource, error) {
+	if cfg.allSources {
+		return d.LogSources(), nil
+	}
+	names := cfg.sources
+	if len(names) == 0 {
+		names = []string{MainLogSource}
+		if req.Target == pb.SearchLogRequest_Slow {
+			names = []string{SlowLogSource}
+		}
+	}
+	var sources []LogSource
+	for _, name := range names {
+		src, ok := d.logSource(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown log source: %s", name)
 		}
-		patterns = append(patterns, re)
+		sources = append(sources, src)
 	}
-	iter := logIterator{
-		begin:     beginTime,
-		end:       endTime,
-		levelFlag: levelFlag,
-		patterns:  patterns,
-		pending:   logFiles,
+	return sources, nil
+}
+
+// newAggregatedSearch starts a log search whose matched items are
+// aggregated, see NewLogSearch for the options accepted.
+func (d *DiagnosticsServer) newAggregatedSearch(ctx context.Context, req *pb.SearchLogRequest, opts []SearchLogOption) (*LogSearch, error) {
+	search, err := d.NewLogSearch(ctx, req, append(opts, WithLimit(-1))...)
+	if err != nil {
+		return nil, err
 	}
-	defer iter.close()
+	if len(search.iter.follow) > 0 {
+		search.Close()
+		return nil, errors.New("cannot aggregate the log search in follow mode")
+	}
+	if search.dedup != nil {
+		search.Close()
+		return nil, errors.New("cannot aggregate the collapsed repeated items")
+	}
+	return search, nil
+}
 
+// Next returns the next matched item. io.EOF is returned at the end of the
+// search or if the limit is reached. In follow mode, it waits for the newly
+// appended lines until the context is canceled.
+func (s *LogSearch) Next() (*LogEntry, error) {
 	for {
-		var messages []*pb.LogMessage
-		var drained bool
-		for i := 0; i < 1024; i++ {
-			item, err := iter.next(ctx)
-			if err == io.EOF {
-				drained = true
-				break
+		entry, err := s.next()
+		if err == nil {
+			s.track(entry)
+		}
+		if err != errNoNewLog {
+			return entry, err
+		}
+		if err := s.iter.wait(s.ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// next is the same as Next, but returns errNoNewLog instead of waiting.
+func (s *LogSearch) next() (*LogEntry, error) {
+	// Stop at the limit and tell the client whether more items match
+	if s.limit > 0 && s.count >= s.limit {
+		if s.lookahead == nil {
+			entry, err := s.read()
+			// The lines appended later are not counted in follow mode
+			if err == io.EOF || err == errNoNewLog {
+				return nil, io.EOF
 			}
 			if err != nil {
-				return err
+				return nil, err
 			}
-			messages = append(messages, item)
+			s.lookahead, s.truncated = entry, true
 		}
-		res := &pb.SearchLogResponse{
-			Messages: messages,
+		return nil, io.EOF
+	}
+	entry, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.count++
+	return entry, nil
+}
+
+func (s *LogSearch) read() (*LogEntry, error) {
+	if s.dedup != nil {
+		return s.dedup.next(s.ctx, &s.iter)
+	}
+	return s.iter.next(s.ctx)
+}
+
+// Truncated reports whether the search has stopped at the limit, and more
+// items match.
+func (s *LogSearch) Truncated() bool {
+	return s.truncated
+}
+
+// Close closes the log files opened by the search.
+func (s *LogSearch) Close() {
+	s.iter.close()
+}
+
+// SearchLog implements the DiagnosticsServer interface.
+func (d *DiagnosticsServer) SearchLog(req *pb.SearchLogRequest, stream pb.Diagnostics_SearchLogServer) error {
+	return d.SearchLogWithOptions(req, stream)
+}
+
+// SearchLogWithOptions is the same as SearchLog, but accepts options which
+// cannot be expressed by the search request.
+func (d *DiagnosticsServer) SearchLogWithOptions(req *pb.SearchLogRequest, stream pb.Diagnostics_SearchLogServer, opts ...SearchLogOption) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = searchLogPanicError(r)
 		}
-		if err := stream.Send(res); err != nil {
-			return err
+	}()
+
+	var cfg searchLogConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.histogram != 0 {
+		return d.sendLogHistogram(req, stream, cfg.histogram, opts)
+	}
+	// The trailer of a followed stream is never sent
+	if cfg.follow && (cfg.highlighted || cfg.dedup) {
+		return errors.New("cannot report highlights or repeats in follow mode")
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	search, err := d.NewLogSearch(ctx, req, opts...)
+	if err != nil {
+		return err
+	}
+	defer search.Close()
+	// The cursor is sent even if the search fails, e.g. the deadline exceeds
+	defer func() {
+		if cursor, err := search.Cursor(); err == nil {
+			stream.SetTrailer(metadata.Pairs(SearchLogCursorKey, cursor))
 		}
-		if drained {
-			break
+	}()
+
+	// The items are read in background, so that the partial batch can be
+	// sent while the search is slow
+	results := make(chan searchLogResult)
+	done := make(chan struct{})
+	go search.produce(ctx, results, done)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	s := d.newSearchLogStream(stream, search)
+	ticker := time.NewTicker(d.searchLogFlushInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-results:
+			switch {
+			case r.err == io.EOF:
+				if err := s.flush(); err != nil {
+					return err
+				}
+				s.setTrailer()
+				return nil
+			case r.err != nil:
+				return r.err
+			case r.entry == nil:
+				// Send the items read so far before waiting for new lines
+				if err := s.flush(); err != nil {
+					return err
+				}
+			default:
+				if err := s.add(r.entry); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			// produce may exit without sending its last result
+			return ctx.Err()
 		}
 	}
-	return nil
+}
+
+// searchLogPanicError logs and returns the error of a panic in a log search.
+func searchLogPanicError(r interface{}) error {
+	buf := make([]byte, 4096)
+	stackSize := runtime.Stack(buf, false)
+	buf = buf[:stackSize]
+	err := fmt.Errorf(fmt.Sprintf("search log panic, %v, stack is %v", r, string(buf)))
+	log.Error(err.Error())
+	return err
 }
 
 // ServerInfo implements the DiagnosticsServer interface.
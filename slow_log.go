@@ -0,0 +1,197 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+)
+
+const (
+	// SlowLogTimePrefix is the prefix of the first line of a slow query log record
+	SlowLogTimePrefix = "# Time: "
+	// SlowLogTimeFormat is the time format of slow query log
+	SlowLogTimeFormat = time.RFC3339Nano
+	// oldSlowLogTimeFormat is the time format used before TiDB 3.0
+	oldSlowLogTimeFormat = "2006-01-02-15:04:05.999999999 -0700"
+)
+
+// SlowLogParser parses the TiDB slow query log, whose records start with a
+// `# Time: ` header followed by `# Key: value` lines and a SQL statement:
+//
+// # Time: 2019-04-28T15:24:04.309074+08:00
+// # Txn_start_ts: 405888132465033227
+// # Query_time: 0.216905
+// # Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772
+// select * from t_slim;
+//
+// Each record is returned as a single item timed by its `# Time: ` header,
+// the message is the rest lines of the record joined by newlines and the
+// level is always LogLevel_UNKNOWN.
+type SlowLogParser struct{}
+
+// ParseLogItem implements the LogParser interface.
+func (SlowLogParser) ParseLogItem(line string) (*pb.LogMessage, error) {
+	if !strings.HasPrefix(line, SlowLogTimePrefix) {
+		return nil, fmt.Errorf("invalid slow log string: %s", line)
+	}
+	ts, err := parseSlowLogTime(strings.TrimSpace(line[len(SlowLogTimePrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LogMessage{Time: ts}, nil
+}
+
+// Multiline implements the MultilineLogParser interface.
+func (SlowLogParser) Multiline() bool {
+	return true
+}
+
+// parseSlowLogTime returns the timestamp in unix milliseconds
+func parseSlowLogTime(s string) (int64, error) {
+	t, err := time.Parse(SlowLogTimeFormat, s)
+	if err != nil {
+		t, err = time.Parse(oldSlowLogTimeFormat, s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// SlowLogDigest is the aggregated statistics of the slow queries which have
+// the same digest.
+type SlowLogDigest struct {
+	Digest         string
+	Count          int64
+	SumQueryTime   float64
+	MaxQueryTime   float64
+	SumProcessTime float64
+	MaxProcessTime float64
+	SumWaitTime    float64
+	MaxWaitTime    float64
+	// SampleQuery is the query of the slowest execution
+	SampleQuery string
+}
+
+func (s *SlowLogDigest) add(queryTime, processTime, waitTime float64, query string) {
+	if s.Count == 0 || queryTime > s.MaxQueryTime {
+		s.SampleQuery = query
+	}
+	s.Count++
+	s.SumQueryTime += queryTime
+	s.MaxQueryTime = math.Max(s.MaxQueryTime, queryTime)
+	s.SumProcessTime += processTime
+	s.MaxProcessTime = math.Max(s.MaxProcessTime, processTime)
+	s.SumWaitTime += waitTime
+	s.MaxWaitTime = math.Max(s.MaxWaitTime, waitTime)
+}
+
+// AggregateSlowLog groups the slow queries in the time range [beginTime, endTime]
+// by digest, and returns the top n digests ordered by the sum of query time.
+// All digests are returned if n <= 0.
+func (d *DiagnosticsServer) AggregateSlowLog(ctx context.Context, beginTime, endTime int64, n int) ([]*SlowLogDigest, error) {
+	if endTime == 0 {
+		endTime = math.MaxInt64
+	}
+	logFiles, err := resolveFiles(ctx, d.slowLogFile, SlowLogParser{}, beginTime, endTime, &cursorThrottle{limits: &d.throttle})
+	if err != nil {
+		return nil, err
+	}
+	iter := logIterator{
+		begin:       beginTime,
+		end:         endTime,
+		multiline:   true,
+		parallelism: d.searchLogParallelism(),
+		throttle:    &d.throttle,
+		pending:     logFiles,
+	}
+	defer iter.close()
+
+	digests := make(map[string]*SlowLogDigest)
+	for {
+		item, err := iter.next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields, query := parseSlowLogRecord(item.Message)
+		digest, ok := digests[fields["Digest"]]
+		if !ok {
+			digest = &SlowLogDigest{Digest: fields["Digest"]}
+			digests[digest.Digest] = digest
+		}
+		digest.add(parseSlowLogDuration(fields["Query_time"]),
+			parseSlowLogDuration(fields["Process_time"]),
+			parseSlowLogDuration(fields["Wait_time"]), query)
+	}
+
+	results := make([]*SlowLogDigest, 0, len(digests))
+	for _, digest := range digests {
+		results = append(results, digest)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].SumQueryTime != results[j].SumQueryTime {
+			return results[i].SumQueryTime > results[j].SumQueryTime
+		}
+		return results[i].Digest < results[j].Digest
+	})
+	if n > 0 && len(results) > n {
+		results = results[:n]
+	}
+	return results, nil
+}
+
+// parseSlowLogRecord parses the message of a slow query log record and returns
+// the `# Key: value` fields and the statement. A field line may contain more
+// than one field, e.g. `# Process_time: 0.161 Request_count: 1 Wait_time: 0.2`.
+func parseSlowLogRecord(message string) (map[string]string, string) {
+	fields := make(map[string]string)
+	var query []string
+	for _, line := range strings.Split(message, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			query = append(query, line)
+			continue
+		}
+		tokens := strings.Fields(line[1:])
+		for i := 0; i+1 < len(tokens); i++ {
+			if strings.HasSuffix(tokens[i], ":") {
+				fields[strings.TrimSuffix(tokens[i], ":")] = tokens[i+1]
+				i++
+			}
+		}
+	}
+	return fields, strings.Join(query, "\n")
+}
+
+// parseSlowLogDuration parses the durations in seconds, invalid durations
+// are treated as zero.
+func parseSlowLogDuration(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
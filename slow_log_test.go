@@ -0,0 +1,216 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysutil_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/pingcap/kvproto/pkg/diagnosticspb"
+	"github.com/pingcap/sysutil"
+	"github.com/stretchr/testify/require"
+)
+
+func slowLogTime(t *testing.T, s string) int64 {
+	tt, err := time.Parse(sysutil.SlowLogTimeFormat, s)
+	require.NoError(t, err)
+	return tt.UnixNano() / int64(time.Millisecond)
+}
+
+func TestSearchSlowLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpGzipFile(t, "rpc.tidb-slow-2019-04-28T15-25-00.000.log.gz", []string{
+		`# Time: 2019-04-28T15:24:04.309074+08:00`,
+		`# Txn_start_ts: 405888132465033227`,
+		`# Query_time: 0.216905`,
+		`# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772`,
+		`select * from t_slim;`,
+	})
+	s.writeTmpFile(t, "rpc.tidb-slow.log", []string{
+		`# Time: 2019-04-28T15:30:04.309074+08:00`,
+		`# Txn_start_ts: 405888132465033228`,
+		`# Query_time: 1.5`,
+		`# Digest: 3f8bf2c2b2a0d4e8`,
+		`select *`,
+		`from t where a = 1;`,
+		`# Time: 2019-04-28T15:31:04.309074+08:00`,
+		`# Txn_start_ts: 405888132465033229`,
+		`# Query_time: 0.5`,
+		`# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772`,
+		`select * from t_slim;`,
+	})
+	// the normal log should not be searched
+	s.writeTmpFile(t, "rpc.tidb.log", []string{
+		`[2019/04/28 15:30:04.309 +08:00] [INFO] [printer.go:41] ["select * from t_slim;"]`,
+	})
+
+	cases := []struct {
+		start, end string
+		patterns   []string
+		expect     []*pb.LogMessage
+	}{
+		{
+			start: "2019-04-28T15:00:00+08:00",
+			end:   "2019-04-28T16:00:00+08:00",
+			expect: []*pb.LogMessage{
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:24:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033227\n# Query_time: 0.216905\n# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772\nselect * from t_slim;",
+				},
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:30:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033228\n# Query_time: 1.5\n# Digest: 3f8bf2c2b2a0d4e8\nselect *\nfrom t where a = 1;",
+				},
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:31:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033229\n# Query_time: 0.5\n# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772\nselect * from t_slim;",
+				},
+			},
+		},
+		{
+			start:    "2019-04-28T15:25:00+08:00",
+			end:      "2019-04-28T15:30:05+08:00",
+			patterns: []string{"(?s)select.*where"},
+			expect: []*pb.LogMessage{
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:30:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033228\n# Query_time: 1.5\n# Digest: 3f8bf2c2b2a0d4e8\nselect *\nfrom t where a = 1;",
+				},
+			},
+		},
+		{
+			start:    "2019-04-28T15:00:00+08:00",
+			end:      "2019-04-28T16:00:00+08:00",
+			patterns: []string{"t_slim"},
+			expect: []*pb.LogMessage{
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:24:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033227\n# Query_time: 0.216905\n# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772\nselect * from t_slim;",
+				},
+				{
+					Time:    slowLogTime(t, "2019-04-28T15:31:04.309074+08:00"),
+					Message: "# Txn_start_ts: 405888132465033229\n# Query_time: 0.5\n# Digest: 42a1c8aae6f133e934d4bf0147491709a8812ea05ff8819ec522780fe657b772\nselect * from t_slim;",
+				},
+			},
+		},
+	}
+
+	for i, cas := range cases {
+		messages := s.searchLog(t, &pb.SearchLogRequest{
+			StartTime: slowLogTime(t, cas.start),
+			EndTime:   slowLogTime(t, cas.end),
+			Patterns:  cas.patterns,
+			Target:    pb.SearchLogRequest_Slow,
+		})
+		require.Equal(t, cas.expect, messages, "case %d", i)
+	}
+}
+
+func TestSlowLogParser(t *testing.T) {
+	item, err := sysutil.SlowLogParser{}.ParseLogItem("# Time: 2019-04-28T15:24:04.309074+08:00")
+	require.NoError(t, err)
+	require.Equal(t, slowLogTime(t, "2019-04-28T15:24:04.309074+08:00"), item.Time)
+
+	item, err = sysutil.SlowLogParser{}.ParseLogItem("# Time: 2019-04-28-15:24:04.309074 +0800")
+	require.NoError(t, err)
+	require.Equal(t, slowLogTime(t, "2019-04-28T15:24:04.309074+08:00"), item.Time)
+
+	for _, line := range []string{
+		"# Query_time: 0.216905",
+		"# Time: yesterday",
+		"select * from t_slim;",
+	} {
+		_, err := sysutil.SlowLogParser{}.ParseLogItem(line)
+		require.Error(t, err, line)
+	}
+}
+
+func TestAggregateSlowLog(t *testing.T) {
+	s, clean := createSearchLogSuite(t)
+	defer clean()
+
+	s.writeTmpGzipFile(t, "rpc.tidb-slow-2019-04-28T15-25-00.000.log.gz", []string{
+		`# Time: 2019-04-28T15:24:04.309074+08:00`,
+		`# Query_time: 0.2`,
+		`# Process_time: 0.1 Wait_time: 0.05 Request_count: 1`,
+		`# Digest: digest_a`,
+		`select * from a where id = 1;`,
+	})
+	s.writeTmpFile(t, "rpc.tidb-slow.log", []string{
+		`# Time: 2019-04-28T15:30:04.309074+08:00`,
+		`# Query_time: 1.5`,
+		`# Process_time: 1.2 Wait_time: 0.1 Request_count: 1`,
+		`# Digest: digest_b`,
+		`select * from b;`,
+		`# Time: 2019-04-28T15:31:04.309074+08:00`,
+		`# Query_time: 0.8`,
+		`# Process_time: 0.3 Request_count: 1`,
+		`# Digest: digest_a`,
+		`use test;`,
+		`select * from a where id = 2;`,
+		`# Time: 2019-04-28T15:32:04.309074+08:00`,
+		`# Query_time: 0.1`,
+		`# Digest: digest_c`,
+		`select 1;`,
+	})
+
+	server := sysutil.NewDiagnosticsServer("", sysutil.WithSlowLogFile(filepath.Join(s.tmpDir, "rpc.tidb-slow.log")))
+	digests, err := server.AggregateSlowLog(context.Background(), 0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []*sysutil.SlowLogDigest{
+		{
+			Digest:         "digest_b",
+			Count:          1,
+			SumQueryTime:   1.5,
+			MaxQueryTime:   1.5,
+			SumProcessTime: 1.2,
+			MaxProcessTime: 1.2,
+			SumWaitTime:    0.1,
+			MaxWaitTime:    0.1,
+			SampleQuery:    "select * from b;",
+		},
+		{
+			Digest:         "digest_a",
+			Count:          2,
+			SumQueryTime:   1.0,
+			MaxQueryTime:   0.8,
+			SumProcessTime: 0.4,
+			MaxProcessTime: 0.3,
+			SumWaitTime:    0.05,
+			MaxWaitTime:    0.05,
+			SampleQuery:    "use test;\nselect * from a where id = 2;",
+		},
+		{
+			Digest:       "digest_c",
+			Count:        1,
+			SumQueryTime: 0.1,
+			MaxQueryTime: 0.1,
+			SampleQuery:  "select 1;",
+		},
+	}, digests)
+
+	// top 1 in a time range
+	digests, err = server.AggregateSlowLog(context.Background(),
+		slowLogTime(t, "2019-04-28T15:31:00+08:00"), slowLogTime(t, "2019-04-28T15:33:00+08:00"), 1)
+	require.NoError(t, err)
+	require.Len(t, digests, 1)
+	require.Equal(t, "digest_a", digests[0].Digest)
+	require.Equal(t, int64(1), digests[0].Count)
+	require.Equal(t, 0.8, digests[0].SumQueryTime)
+}